@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 
 	"github.com/ryszard/agency/client"
+	"github.com/ryszard/agency/util/trace"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -111,14 +113,23 @@ func (ag *BaseAgent) System(message string, data ...any) (string, error) {
 	return message, nil
 }
 
+// Listen implements Agent. The data may contain client.ContentPart values
+// (for example images created with client.ImageURLPart), which will be
+// attached to the message after its text.
 func (ag *BaseAgent) Listen(message string, data ...any) (string, error) {
 	log.WithField("message", message).WithField("agent", ag.Name()).Trace("Listen")
-	if len(data) > 0 {
-		return "", errors.New("this agent does not support passing data to Listen")
+	var parts []client.ContentPart
+	for _, datum := range data {
+		part, ok := datum.(client.ContentPart)
+		if !ok {
+			return "", fmt.Errorf("this agent only supports passing client.ContentPart to Listen, got %T", datum)
+		}
+		parts = append(parts, part)
 	}
 	ag.Append(client.Message{
 		Content: message,
 		Role:    client.User,
+		Parts:   parts,
 	})
 	log.WithField("messages", ag.Messages()).WithField("agent", ag.Name()).Trace("Listen Messages")
 
@@ -147,23 +158,50 @@ func (ag *BaseAgent) createRequest(options []Option) (Config, client.ChatComplet
 	return cfg, req
 }
 
-func (ag *BaseAgent) Respond(ctx context.Context, options ...Option) (message string, err error) {
-	logger := log.WithField("agent", ag.name)
-	logger.Debug("Responding to message")
+// prepare returns the config and request for a call to the client, using the
+// agent's memory if it has one. If the client implements client.Capabilities,
+// the request is validated against it.
+func (ag *BaseAgent) prepare(ctx context.Context, options []Option) (Config, client.ChatCompletionRequest, error) {
 	cfg, req := ag.createRequest(options)
 
+	if caps, ok := client.CapabilitiesOf(cfg.Client); ok {
+		if err := client.Validate(caps, req); err != nil {
+			return Config{}, client.ChatCompletionRequest{}, err
+		}
+	}
+
 	if cfg.Memory != nil {
 		log.Debug("Using memory")
+		ctx, span := trace.Start(ctx, "agent.Memory")
+		span.SetAttribute("agent", ag.name)
+		span.SetAttribute("messages_before", len(ag.messages))
 		newMessages, err := cfg.Memory(ctx, cfg, ag.messages)
+		span.SetAttribute("messages_after", len(newMessages))
+		span.End(err)
 		if err != nil {
 			log.WithError(err).Error("Failed to use memory")
-			return "", err
+			return Config{}, client.ChatCompletionRequest{}, err
 		}
 		ag.messages = newMessages
 	}
+	return cfg, req, nil
+}
+
+func (ag *BaseAgent) Respond(ctx context.Context, options ...Option) (message string, err error) {
+	logger := log.WithField("agent", ag.name)
+	logger.Debug("Responding to message")
+	ctx = client.WithAgentName(ctx, ag.name)
+	ctx, span := trace.Start(ctx, "agent.Respond")
+	span.SetAttribute("agent", ag.name)
+	defer func() { span.End(err) }()
+
+	cfg, req, err := ag.prepare(ctx, options)
+	if err != nil {
+		return "", err
+	}
 
 	logger.WithField("request", fmt.Sprintf("%+v", req)).Debug("Sending request")
-	resp, err := cfg.Client.CreateChatCompletion(ctx, req)
+	resp, err := createChatCompletion(ctx, cfg.Client, req)
 	logger.WithError(err).WithField("response", fmt.Sprintf("%+v", resp)).Debug("Received response from client")
 	if err != nil {
 		logger.WithError(err).Error("Failed to send request to OpenAI API")
@@ -171,8 +209,126 @@ func (ag *BaseAgent) Respond(ctx context.Context, options ...Option) (message st
 	}
 	logger.WithField("response", fmt.Sprintf("%+v", resp)).Debug("Received response from client")
 
-	msg := resp.Choices[0]
+	msg := resp.Choices[0].Message
+	if resp.Choices[0].FinishReason == client.FinishReasonLength {
+		logger.WithField("max_tokens", req.MaxTokens).Warn("Response was truncated")
+	}
 	ag.Append(msg)
 
 	return msg.Content, nil
 }
+
+// createChatCompletion sends req to cl in a span, recording the model and the
+// usage. Client wrappers add more attributes, like whether the response came
+// from the cache or how many attempts were made.
+func createChatCompletion(ctx context.Context, cl client.Client, req client.ChatCompletionRequest) (resp client.ChatCompletionResponse, err error) {
+	ctx, span := startChatCompletion(ctx, req)
+	defer func() { span.End(err) }()
+
+	resp, err = cl.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	setResponseAttributes(span, resp)
+	return resp, nil
+}
+
+// startChatCompletion starts the span of a request to the client.
+func startChatCompletion(ctx context.Context, req client.ChatCompletionRequest) (context.Context, trace.Span) {
+	ctx, span := trace.Start(ctx, "client.CreateChatCompletion")
+	span.SetAttribute("model", req.Model)
+	span.SetAttribute("messages", len(req.Messages))
+	return ctx, span
+}
+
+// setResponseAttributes records the usage and finish reason of resp in span.
+func setResponseAttributes(span trace.Span, resp client.ChatCompletionResponse) {
+	span.SetAttribute("prompt_tokens", resp.Usage.PromptTokens)
+	span.SetAttribute("completion_tokens", resp.Usage.CompletionTokens)
+	if len(resp.Choices) > 0 {
+		span.SetAttribute("finish_reason", string(resp.Choices[0].FinishReason))
+	}
+}
+
+// RespondStream is like Respond, but returns the response as a stream of
+// events, as they arrive from the client. The response is appended to the
+// agent's messages once the stream is read until io.EOF. The caller is
+// responsible for closing the stream. The agent's client has to implement
+// client.StreamingClient, otherwise client.ErrStreamingNotSupported is
+// returned. The spans of the response end when the stream does.
+func (ag *BaseAgent) RespondStream(ctx context.Context, options ...Option) (stream client.ChatCompletionStream, err error) {
+	logger := log.WithField("agent", ag.name)
+	logger.Debug("Responding to message (stream)")
+	ctx = client.WithAgentName(ctx, ag.name)
+	ctx, span := trace.Start(ctx, "agent.Respond")
+	span.SetAttribute("agent", ag.name)
+	span.SetAttribute("stream", true)
+	defer func() {
+		if err != nil {
+			span.End(err)
+		}
+	}()
+
+	cfg, req, err := ag.prepare(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	streaming, ok := cfg.Client.(client.StreamingClient)
+	if !ok {
+		return nil, client.ErrStreamingNotSupported
+	}
+
+	logger.WithField("request", fmt.Sprintf("%+v", req)).Debug("Sending request")
+	callCtx, callSpan := startChatCompletion(ctx, req)
+	stream, err = streaming.CreateChatCompletionStream(callCtx, req)
+	if err != nil {
+		callSpan.End(err)
+		logger.WithError(err).Error("Failed to send request")
+		return nil, err
+	}
+	return &agentStream{ChatCompletionStream: stream, agent: ag, span: span, callSpan: callSpan}, nil
+}
+
+// agentStream appends the streamed message to the agent once it's complete,
+// and ends the spans of the response when the stream ends or is closed.
+type agentStream struct {
+	client.ChatCompletionStream
+	agent    *BaseAgent
+	span     trace.Span
+	callSpan trace.Span
+	acc      client.StreamAccumulator
+	done     bool
+	ended    bool
+}
+
+// end ends the spans, once.
+func (s *agentStream) end(err error) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.callSpan.End(err)
+	s.span.End(err)
+}
+
+func (s *agentStream) Recv() (client.StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if errors.Is(err, io.EOF) && !s.done {
+		s.done = true
+		resp := s.acc.Response()
+		setResponseAttributes(s.callSpan, resp)
+		s.end(nil)
+		s.agent.Append(resp.Choices[0].Message)
+	} else if err == nil {
+		s.acc.Add(event)
+	} else if !errors.Is(err, io.EOF) {
+		s.end(err)
+	}
+	return event, err
+}
+
+func (s *agentStream) Close() error {
+	s.end(nil)
+	return s.ChatCompletionStream.Close()
+}
@@ -3,10 +3,12 @@ package agent
 import (
 	"context"
 	"errors"
+	"io"
 	"reflect"
 	"testing"
 
 	"github.com/ryszard/agency/client"
+	"github.com/ryszard/agency/util/trace"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -51,6 +53,26 @@ func TestAgentInject(t *testing.T) {
 
 }
 
+func TestAgentListenWithImages(t *testing.T) {
+	ag := &BaseAgent{}
+	image := client.ImageURLPart("https://example.com/cat.png")
+
+	_, err := ag.Listen("What's in this image?", image)
+	assert.NoError(t, err)
+
+	want := []client.Message{
+		{
+			Content: "What's in this image?",
+			Role:    client.User,
+			Parts:   []client.ContentPart{image},
+		},
+	}
+	assert.Equal(t, want, ag.Messages())
+
+	_, err = ag.Listen("Hello", "not a content part")
+	assert.Error(t, err)
+}
+
 type MockClient struct {
 	mock.Mock
 }
@@ -68,13 +90,16 @@ func TestRespond(t *testing.T) {
 	}
 
 	expectedResp := client.ChatCompletionResponse{
-		Choices: []client.Message{
-			{Content: "Response", Role: "assistant"},
+		Choices: []client.Choice{
+			{Message: client.Message{Content: "Response", Role: "assistant"}},
 		},
 	}
 
+	// Respond passes the agent's name to the client through the context.
+	agentCtx := client.WithAgentName(ctx, "Test")
+
 	mockClient := &MockClient{}
-	mockCall := mockClient.On("CreateChatCompletion", ctx, mock.Anything).Return(expectedResp, nil)
+	mockCall := mockClient.On("CreateChatCompletion", agentCtx, mock.Anything).Return(expectedResp, nil)
 
 	ac := NewBaseAgent("Test", WithClient(mockClient))
 	ac.messages = messages
@@ -88,14 +113,149 @@ func TestRespond(t *testing.T) {
 	expectedReq := client.ChatCompletionRequest{
 		Messages: messages,
 	}
-	mockClient.AssertCalled(t, "CreateChatCompletion", ctx, expectedReq)
+	mockClient.AssertCalled(t, "CreateChatCompletion", agentCtx, expectedReq)
 
 	// Test error case
 	mockCall.Unset()
 	expectedErr := errors.New("API error")
-	mockClient.On("CreateChatCompletion", ctx, mock.Anything).Return(client.ChatCompletionResponse{}, expectedErr)
+	mockClient.On("CreateChatCompletion", agentCtx, mock.Anything).Return(client.ChatCompletionResponse{}, expectedErr)
 
 	_, err = ac.Respond(ctx)
 	assert.Error(t, err)
 	assert.Equal(t, expectedErr, err)
 }
+
+type streamingClient struct {
+	MockClient
+	events []client.StreamEvent
+}
+
+type eventStream struct {
+	events []client.StreamEvent
+}
+
+func (s *eventStream) Recv() (client.StreamEvent, error) {
+	if len(s.events) == 0 {
+		return client.StreamEvent{}, io.EOF
+	}
+	event := s.events[0]
+	s.events = s.events[1:]
+	return event, nil
+}
+
+func (s *eventStream) Close() error {
+	return nil
+}
+
+func (c *streamingClient) CreateChatCompletionStream(ctx context.Context, req client.ChatCompletionRequest) (client.ChatCompletionStream, error) {
+	return &eventStream{events: c.events}, nil
+}
+
+func TestRespondStream(t *testing.T) {
+	cl := &streamingClient{events: []client.StreamEvent{
+		{Content: "Hello, "},
+		{Content: "world!", FinishReason: client.FinishReasonStop},
+	}}
+
+	ag := NewBaseAgent("Test", WithClient(cl))
+	ag.Listen("Hi")
+
+	stream, err := ag.RespondStream(context.Background())
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	var contents []string
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		contents = append(contents, event.Content)
+	}
+
+	assert.Equal(t, []string{"Hello, ", "world!"}, contents)
+	assert.Equal(t, []client.Message{
+		{Content: "Hi", Role: client.User},
+		{Content: "Hello, world!", Role: client.Assistant},
+	}, ag.Messages())
+}
+
+func TestRespondStreamNotSupported(t *testing.T) {
+	ag := NewBaseAgent("Test", WithClient(&MockClient{}))
+	_, err := ag.RespondStream(context.Background())
+	assert.ErrorIs(t, err, client.ErrStreamingNotSupported)
+}
+
+type recordingExporter struct {
+	records []trace.Record
+}
+
+func (e *recordingExporter) Export(record trace.Record) error {
+	e.records = append(e.records, record)
+	return nil
+}
+
+func TestRespondTracing(t *testing.T) {
+	exporter := &recordingExporter{}
+	trace.SetTracer(trace.NewTracer(exporter))
+	t.Cleanup(func() { trace.SetTracer(nil) })
+
+	mockClient := &MockClient{}
+	mockClient.On("CreateChatCompletion", mock.Anything, mock.Anything).Return(client.ChatCompletionResponse{
+		Choices: []client.Choice{{Message: client.Message{Content: "Response", Role: "assistant"}, FinishReason: client.FinishReasonStop}},
+		Usage:   client.Usage{PromptTokens: 3, CompletionTokens: 1, TotalTokens: 4},
+	}, nil)
+	ag := NewBaseAgent("Test", WithClient(mockClient), WithModel("gpt-4"), WithMemory(BufferMemory(10)))
+	ag.Listen("Hello")
+
+	_, err := ag.Respond(context.Background())
+	assert.NoError(t, err)
+
+	names := make(map[string]trace.Record)
+	for _, record := range exporter.records {
+		names[record.Name] = record
+	}
+	respond, memory, call := names["agent.Respond"], names["agent.Memory"], names["client.CreateChatCompletion"]
+	assert.Equal(t, respond.SpanID, memory.ParentID)
+	assert.Equal(t, respond.SpanID, call.ParentID)
+	assert.Equal(t, "Test", respond.Attributes["agent"])
+	assert.Equal(t, "gpt-4", call.Attributes["model"])
+	assert.Equal(t, 3, call.Attributes["prompt_tokens"])
+}
+
+func TestRespondStreamTracing(t *testing.T) {
+	exporter := &recordingExporter{}
+	trace.SetTracer(trace.NewTracer(exporter))
+	t.Cleanup(func() { trace.SetTracer(nil) })
+
+	usage := client.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}
+	cl := &streamingClient{events: []client.StreamEvent{
+		{Content: "Hello, "},
+		{Content: "world!", FinishReason: client.FinishReasonStop, Usage: &usage},
+	}}
+	ag := NewBaseAgent("Test", WithClient(cl), WithModel("gpt-4"), WithMemory(BufferMemory(10)))
+	ag.Listen("Hi")
+
+	stream, err := ag.RespondStream(context.Background())
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Len(t, exporter.records, 1, "only the memory span ends before the stream does")
+	_, err = client.CollectStream(stream, nil)
+	assert.NoError(t, err)
+
+	names := make(map[string]trace.Record)
+	for _, record := range exporter.records {
+		names[record.Name] = record
+	}
+	assert.Len(t, exporter.records, 3)
+	respond, memory, call := names["agent.Respond"], names["agent.Memory"], names["client.CreateChatCompletion"]
+	assert.Equal(t, respond.SpanID, memory.ParentID)
+	assert.Equal(t, respond.SpanID, call.ParentID)
+	assert.Equal(t, "Test", respond.Attributes["agent"])
+	assert.Equal(t, "gpt-4", call.Attributes["model"])
+	assert.Equal(t, 3, call.Attributes["prompt_tokens"])
+	assert.Equal(t, 2, call.Attributes["completion_tokens"])
+	assert.Equal(t, string(client.FinishReasonStop), call.Attributes["finish_reason"])
+}
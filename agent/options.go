@@ -69,7 +69,90 @@ func WithMaxTokens(maxTokens int) Option {
 // WithTemperature sets Temperature for the agent.
 func WithTemperature(temperature float32) Option {
 	return func(ac *Config) {
-		ac.RequestTemplate.Temperature = temperature
+		ac.RequestTemplate.Temperature = &temperature
+	}
+}
+
+// WithTopP sets TopP (nucleus sampling) for the agent.
+func WithTopP(topP float32) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.TopP = &topP
+	}
+}
+
+// WithTopK sets TopK for the agent.
+func WithTopK(topK int) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.TopK = &topK
+	}
+}
+
+// WithStop sets the sequences that will make the model stop generating.
+func WithStop(stop ...string) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.Stop = stop
+	}
+}
+
+// WithSeed sets Seed for the agent. Providers that support it will try to
+// sample deterministically.
+func WithSeed(seed int) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.Seed = &seed
+	}
+}
+
+// WithPresencePenalty sets PresencePenalty for the agent.
+func WithPresencePenalty(penalty float32) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.PresencePenalty = &penalty
+	}
+}
+
+// WithFrequencyPenalty sets FrequencyPenalty for the agent.
+func WithFrequencyPenalty(penalty float32) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.FrequencyPenalty = &penalty
+	}
+}
+
+// WithN sets the number of choices the model should generate. Note that
+// Respond only uses the first one.
+func WithN(n int) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.N = n
+	}
+}
+
+// WithUser sets the identifier of the end user.
+func WithUser(user string) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.User = user
+	}
+}
+
+// WithPriority sets the priority of the agent's requests, for client wrappers
+// that queue requests (like client.Queued). Higher values go first.
+func WithPriority(priority int) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.Priority = priority
+	}
+}
+
+// WithTools sets the tools that the model may call. If the model decides to
+// call any of them, the calls will be available in the ToolCalls field of the
+// last message returned by Messages. You should pass the results back to the
+// agent by appending messages with the client.Tool role.
+func WithTools(tools ...client.ToolDefinition) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.Tools = tools
+	}
+}
+
+// WithToolChoice sets ToolChoice for the agent.
+func WithToolChoice(choice client.ToolChoice) Option {
+	return func(ac *Config) {
+		ac.RequestTemplate.ToolChoice = choice
 	}
 }
 
@@ -18,6 +18,7 @@ import (
 	"text/template"
 
 	"github.com/ryszard/agency/agent"
+	"github.com/ryszard/agency/util/trace"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -53,7 +54,9 @@ func NewReAct(ag agent.Agent, w io.Writer, tpl *template.Template, tools ...Tool
 }
 
 // Answer ask the agent a question and returns the answer.
-func (reactor *ReAct) Answer(ctx context.Context, question string, options ...agent.Option) error {
+func (reactor *ReAct) Answer(ctx context.Context, question string, options ...agent.Option) (err error) {
+	ctx, span := trace.Start(ctx, "react.Answer")
+	defer func() { span.End(err) }()
 
 	if !reactor.initialized {
 		var sb strings.Builder
@@ -68,13 +71,12 @@ func (reactor *ReAct) Answer(ctx context.Context, question string, options ...ag
 	}
 	entries := []Entry{}
 
-	_, err := reactor.agent.System(fmt.Sprintf("Question: %s", question))
-	if err != nil {
+	if _, err := reactor.agent.System(fmt.Sprintf("Question: %s", question)); err != nil {
 		return err
 	}
 
 	for {
-		msg, err := reactor.agent.Respond(context.Background(), options...)
+		msg, err := reactor.agent.Respond(ctx, options...)
 		if err != nil {
 			return err
 		}
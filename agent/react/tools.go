@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"sort"
+
+	"github.com/ryszard/agency/util/trace"
 )
 
 // Tool is an interface encapsulating a tool that can be used by the agent.
@@ -48,9 +50,15 @@ func newToolbox(tools ...Tool) *toolbox {
 }
 
 func (box *toolbox) Work(ctx context.Context, argument, content string) (observation string, err error) {
+	ctx, span := trace.Start(ctx, "react.Tool.Work")
+	defer func() { span.End(err) }()
+	span.SetAttribute("tool", argument)
+
 	tool, ok := box.tools[argument]
 	if !ok {
 		return "", fmt.Errorf("unknown tool: %q", argument)
 	}
-	return tool.Work(ctx, argument, content)
+	observation, err = tool.Work(ctx, argument, content)
+	span.SetAttribute("observation_length", len(observation))
+	return observation, err
 }
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RateLimit is the state of a provider's rate limits, as reported with a
+// response (for example in the x-ratelimit-* headers of OpenAI). Limits that
+// the provider didn't report are zero.
+type RateLimit struct {
+	LimitRequests     int
+	RemainingRequests int
+	// ResetRequests is when the remaining requests will be back to the
+	// limit.
+	ResetRequests time.Time
+
+	LimitTokens     int
+	RemainingTokens int
+	// ResetTokens is when the remaining tokens will be back to the limit.
+	ResetTokens time.Time
+}
+
+// AdaptiveLimiter is a Limiter that slows down requests when the rate limits
+// reported by the provider are close to being exhausted, and speeds them up
+// again once the limits reset. It has to be told about the responses with
+// Observe, which AdaptiveRateLimiting does.
+type AdaptiveLimiter struct {
+	threshold float64
+
+	mu          sync.Mutex
+	limit       RateLimit
+	perRequest  int
+	next        time.Time
+	pausedUntil time.Time
+}
+
+// NewAdaptiveLimiter returns an AdaptiveLimiter that starts pacing requests
+// once the remaining requests or tokens fall below threshold (a fraction of
+// the limit, like 0.2). While pacing, the remaining capacity is spread evenly
+// until the reset; if it is exhausted, requests wait for the reset.
+func NewAdaptiveLimiter(threshold float64) *AdaptiveLimiter {
+	if threshold <= 0 || threshold > 1 {
+		panic("threshold must be in (0, 1]")
+	}
+	return &AdaptiveLimiter{threshold: threshold}
+}
+
+var _ Limiter = (*AdaptiveLimiter)(nil)
+
+// Observe updates the limiter with the rate limits reported with a response,
+// and the usage of that response, which is used to estimate how many
+// requests the remaining tokens are good for.
+func (l *AdaptiveLimiter) Observe(limit RateLimit, usage Usage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	if usage.TotalTokens > 0 {
+		l.perRequest = usage.TotalTokens
+	}
+	// If a limit is exhausted, nothing can be sent before it resets.
+	if limit.LimitRequests > 0 && limit.RemainingRequests <= 0 && limit.ResetRequests.After(l.pausedUntil) {
+		l.pausedUntil = limit.ResetRequests
+	}
+	if limit.LimitTokens > 0 && limit.RemainingTokens <= 0 && limit.ResetTokens.After(l.pausedUntil) {
+		l.pausedUntil = limit.ResetTokens
+	}
+}
+
+// PauseUntil makes requests wait until t, for example because the provider
+// asked to retry after that.
+func (l *AdaptiveLimiter) PauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.pausedUntil) {
+		l.pausedUntil = t
+	}
+}
+
+// interval returns how far apart requests should be, given the last observed
+// rate limits.
+func (l *AdaptiveLimiter) interval(now time.Time) time.Duration {
+	perRequest := l.perRequest
+	if perRequest == 0 {
+		perRequest = 1
+	}
+	requests := l.dimensionInterval(now, l.limit.LimitRequests, l.limit.RemainingRequests, l.limit.ResetRequests, 1)
+	tokens := l.dimensionInterval(now, l.limit.LimitTokens, l.limit.RemainingTokens, l.limit.ResetTokens, perRequest)
+	if tokens > requests {
+		return tokens
+	}
+	return requests
+}
+
+func (l *AdaptiveLimiter) dimensionInterval(now time.Time, limit, remaining int, reset time.Time, perRequest int) time.Duration {
+	if limit <= 0 || !now.Before(reset) {
+		return 0
+	}
+	if float64(remaining)/float64(limit) >= l.threshold {
+		return 0
+	}
+	untilReset := reset.Sub(now)
+	requestsLeft := remaining / perRequest
+	if requestsLeft < 1 {
+		return untilReset
+	}
+	return untilReset / time.Duration(requestsLeft)
+}
+
+// Wait implements Limiter.
+func (l *AdaptiveLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	start := now
+	if l.pausedUntil.After(start) {
+		start = l.pausedUntil
+	}
+	if interval := l.interval(now); interval > 0 {
+		if l.next.After(start) {
+			start = l.next
+		}
+		l.next = start.Add(interval)
+	}
+	l.mu.Unlock()
+
+	wait := start.Sub(now)
+	if wait <= 0 {
+		return nil
+	}
+	log.WithField("wait", wait).Debug("Adaptive limiter slowing down")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type adaptiveRateLimitingClient struct {
+	client  Client
+	limiter *AdaptiveLimiter
+}
+
+// AdaptiveRateLimiting wraps a Client and rate limits requests with limiter,
+// updating it with the rate limits reported in the responses (see
+// ChatCompletionResponse.RateLimit). A rate limit error that says how long to
+// wait (see RetryableError.RetryAfter) pauses all requests for that long. The
+// same limiter should be shared by all the clients using the same API key.
+func AdaptiveRateLimiting(client Client, limiter *AdaptiveLimiter) Client {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	return &adaptiveRateLimitingClient{
+		client:  client,
+		limiter: limiter,
+	}
+}
+
+func (client *adaptiveRateLimitingClient) observe(resp ChatCompletionResponse, err error) {
+	var rerr *RetryableError
+	if errors.As(err, &rerr) && rerr.rateLimited && rerr.RetryAfter() > 0 {
+		client.limiter.PauseUntil(time.Now().Add(rerr.RetryAfter()))
+	}
+	if err == nil && resp.RateLimit != nil {
+		client.limiter.Observe(*resp.RateLimit, resp.Usage)
+	}
+}
+
+func (client *adaptiveRateLimitingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	if err := client.limiter.Wait(ctx); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	resp, err := client.client.CreateChatCompletion(ctx, req)
+	client.observe(resp, err)
+	return resp, err
+}
+
+// CreateChatCompletionStream implements StreamingClient.
+func (client *adaptiveRateLimitingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	if err := client.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		client.observe(ChatCompletionResponse{}, err)
+		return nil, err
+	}
+	return &adaptiveStream{ChatCompletionStream: stream, limiter: client.limiter}, nil
+}
+
+// adaptiveStream updates the limiter with the rate limits reported in the
+// events of a stream.
+type adaptiveStream struct {
+	ChatCompletionStream
+	limiter *AdaptiveLimiter
+}
+
+func (s *adaptiveStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err == nil && event.RateLimit != nil {
+		s.limiter.Observe(*event.RateLimit, Usage{})
+	}
+	return event, err
+}
+
+// Unwrap implements Wrapper.
+func (client *adaptiveRateLimitingClient) Unwrap() Client {
+	return client.client
+}
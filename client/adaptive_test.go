@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveLimiterInterval(t *testing.T) {
+	now := time.Now()
+	limiter := NewAdaptiveLimiter(0.2)
+	assert.Equal(t, time.Duration(0), limiter.interval(now), "nothing observed yet")
+
+	// Above the threshold.
+	limiter.Observe(RateLimit{LimitRequests: 100, RemainingRequests: 50, ResetRequests: now.Add(time.Minute)}, Usage{})
+	assert.Equal(t, time.Duration(0), limiter.interval(now))
+
+	// Below the threshold, the remaining requests are spread until the
+	// reset.
+	limiter.Observe(RateLimit{LimitRequests: 100, RemainingRequests: 10, ResetRequests: now.Add(time.Minute)}, Usage{})
+	assert.Equal(t, 6*time.Second, limiter.interval(now))
+
+	// The remaining tokens are good for 2 requests of 1000 tokens.
+	limiter.Observe(RateLimit{
+		LimitRequests: 100, RemainingRequests: 90, ResetRequests: now.Add(time.Minute),
+		LimitTokens: 100000, RemainingTokens: 2000, ResetTokens: now.Add(time.Minute),
+	}, Usage{TotalTokens: 1000})
+	assert.Equal(t, 30*time.Second, limiter.interval(now))
+
+	// After the reset, there's no need to slow down.
+	assert.Equal(t, time.Duration(0), limiter.interval(now.Add(2*time.Minute)))
+}
+
+func TestAdaptiveRateLimitingPausesOnRateLimitErrors(t *testing.T) {
+	limiter := NewAdaptiveLimiter(0.2)
+	cl := AdaptiveRateLimiting(failing(RateLimitedAfter(errors.New("429"), time.Hour)), limiter)
+
+	_, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.True(t, IsRateLimited(err))
+
+	_, err = cl.CreateChatCompletion(quickly(t), ChatCompletionRequest{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
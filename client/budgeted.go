@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Price is the price of using a model, in dollars per 1000 tokens.
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// Cost returns the cost in dollars of the given usage.
+func (p Price) Cost(usage Usage) float64 {
+	return (float64(usage.PromptTokens)*p.Prompt + float64(usage.CompletionTokens)*p.Completion) / 1000
+}
+
+// Budget configures Budgeted.
+type Budget struct {
+	// Limit is the maximum amount of dollars that can be spent. Zero means
+	// that there is no limit, and spending is only tracked.
+	Limit float64
+
+	// Prices maps model names to their prices. If there is a Limit,
+	// requests for models that are not in Prices will be refused, as their
+	// cost is unknown; otherwise they are tracked as free.
+	Prices map[string]Price
+
+	// CountTokens is used to estimate usage when the wrapped client doesn't
+	// report it (for example when streaming). It is required if there is a
+	// Limit, as otherwise such requests would be tracked as free and the
+	// limit would never be reached; without a Limit, they are tracked as
+	// free.
+	CountTokens func(string) (int, error)
+}
+
+// BudgetExceededError is returned by BudgetedClient when the budget has
+// already been spent.
+type BudgetExceededError struct {
+	Limit float64
+	Spent float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("budget exceeded: spent $%.4f of $%.4f", e.Spent, e.Limit)
+}
+
+// Spending is a running total of the requests made through BudgetedClient.
+type Spending struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+func (s *Spending) add(usage Usage, cost float64) {
+	s.Requests++
+	s.PromptTokens += usage.PromptTokens
+	s.CompletionTokens += usage.CompletionTokens
+	s.Cost += cost
+}
+
+// BudgetedClient is a Client that keeps track of how much is being spent, and
+// refuses to make requests once its budget is exhausted.
+type BudgetedClient struct {
+	client Client
+	budget Budget
+
+	mu      sync.Mutex
+	total   Spending
+	byModel map[string]*Spending
+	byAgent map[string]*Spending
+}
+
+// Budgeted wraps a client and tracks spending using the prices from budget.
+// Once the spending reaches budget.Limit, all subsequent requests will fail
+// with a *BudgetExceededError. Note that requests that are already in flight
+// when the limit is reached will still be made, so the limit can be slightly
+// exceeded. Budgeted panics if budget has a Limit but no CountTokens.
+func Budgeted(client Client, budget Budget) *BudgetedClient {
+	if budget.Limit > 0 && budget.CountTokens == nil {
+		panic("a budget with a limit needs CountTokens")
+	}
+	return &BudgetedClient{
+		client:  client,
+		budget:  budget,
+		byModel: make(map[string]*Spending),
+		byAgent: make(map[string]*Spending),
+	}
+}
+
+var _ StreamingClient = (*BudgetedClient)(nil)
+
+// check returns the price of the model of req, or an error if the request
+// must be refused.
+func (c *BudgetedClient) check(req ChatCompletionRequest) (Price, error) {
+	price, ok := c.budget.Prices[req.Model]
+	if !ok {
+		if c.budget.Limit > 0 {
+			return Price{}, fmt.Errorf("budgeted: no price for model %q", req.Model)
+		}
+		log.WithField("model", req.Model).Warn("budgeted: no price for model, tracking it as free")
+	}
+
+	c.mu.Lock()
+	spent := c.total.Cost
+	c.mu.Unlock()
+	if c.budget.Limit > 0 && spent >= c.budget.Limit {
+		return Price{}, &BudgetExceededError{Limit: c.budget.Limit, Spent: spent}
+	}
+	return price, nil
+}
+
+// charge adds the cost of resp to the spending. If resp doesn't report its
+// usage, it is estimated with CountTokens.
+func (c *BudgetedClient) charge(ctx context.Context, req ChatCompletionRequest, price Price, resp ChatCompletionResponse) error {
+	usage := resp.Usage
+	if usage == (Usage{}) && c.budget.CountTokens != nil {
+		var err error
+		usage, err = estimateUsage(c.budget.CountTokens, req, resp)
+		if err != nil {
+			return err
+		}
+	}
+	cost := price.Cost(usage)
+
+	agent := AgentName(ctx)
+	log.WithFields(log.Fields{
+		"model": req.Model,
+		"agent": agent,
+		"usage": usage,
+		"cost":  cost,
+	}).Debug("budgeted: request cost")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total.add(usage, cost)
+	if c.byModel[req.Model] == nil {
+		c.byModel[req.Model] = &Spending{}
+	}
+	c.byModel[req.Model].add(usage, cost)
+	if c.byAgent[agent] == nil {
+		c.byAgent[agent] = &Spending{}
+	}
+	c.byAgent[agent].add(usage, cost)
+	return nil
+}
+
+func (c *BudgetedClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	price, err := c.check(req)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+
+	resp, err := c.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	if err := c.charge(ctx, req, price, resp); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	return resp, nil
+}
+
+// CreateChatCompletionStream implements StreamingClient. The budget is checked
+// before the stream is opened, and the request is charged once, when the
+// stream ends or is closed, for the usage it reported or, if it didn't, for
+// the estimated usage of what was received.
+func (c *BudgetedClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := c.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	price, err := c.check(req)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &budgetedStream{
+		ChatCompletionStream: stream,
+		charge: func(resp ChatCompletionResponse) error {
+			return c.charge(ctx, req, price, resp)
+		},
+	}, nil
+}
+
+// budgetedStream calls charge once, when the stream ends or is closed.
+type budgetedStream struct {
+	ChatCompletionStream
+	charge  func(ChatCompletionResponse) error
+	acc     StreamAccumulator
+	charged bool
+}
+
+func (s *budgetedStream) finish() error {
+	if s.charged {
+		return nil
+	}
+	s.charged = true
+	return s.charge(s.acc.Response())
+}
+
+func (s *budgetedStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err == nil {
+		s.acc.Add(event)
+		return event, nil
+	}
+	// A failed stream may have been billed for what it generated.
+	if chargeErr := s.finish(); chargeErr != nil {
+		if err == io.EOF {
+			return StreamEvent{}, chargeErr
+		}
+		log.WithError(chargeErr).Error("budgeted: failed to charge a stream")
+	}
+	return event, err
+}
+
+func (s *budgetedStream) Close() error {
+	// A stream closed early is charged for what was received.
+	if err := s.finish(); err != nil {
+		log.WithError(err).Error("budgeted: failed to charge a stream")
+	}
+	return s.ChatCompletionStream.Close()
+}
+
+// estimateUsage estimates the usage of a request and its response by
+// counting the tokens of the messages with countTokens.
+func estimateUsage(countTokens func(string) (int, error), req ChatCompletionRequest, resp ChatCompletionResponse) (Usage, error) {
+	var usage Usage
+	var err error
+	usage.PromptTokens, err = countPromptTokens(countTokens, req)
+	if err != nil {
+		return Usage{}, err
+	}
+	for _, choice := range resp.Choices {
+		count, err := countTokens(choice.Text())
+		if err != nil {
+			return Usage{}, err
+		}
+		usage.CompletionTokens += count
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage, nil
+}
+
+// countPromptTokens counts the tokens of the messages of req.
+func countPromptTokens(countTokens func(string) (int, error), req ChatCompletionRequest) (int, error) {
+	tokens := 0
+	for _, msg := range req.Messages {
+		count, err := countTokens(msg.Text())
+		if err != nil {
+			return 0, err
+		}
+		tokens += count
+	}
+	return tokens, nil
+}
+
+// Unwrap implements Wrapper.
+func (c *BudgetedClient) Unwrap() Client {
+	return c.client
+}
+
+// Total returns the spending across all models and agents.
+func (c *BudgetedClient) Total() Spending {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// ByModel returns the spending for each model.
+func (c *BudgetedClient) ByModel() map[string]Spending {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copySpending(c.byModel)
+}
+
+// ByAgent returns the spending for each agent name. Requests that weren't
+// made by an agent are under the empty name.
+func (c *BudgetedClient) ByAgent() map[string]Spending {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return copySpending(c.byAgent)
+}
+
+func copySpending(m map[string]*Spending) map[string]Spending {
+	out := make(map[string]Spending, len(m))
+	for k, v := range m {
+		out[k] = *v
+	}
+	return out
+}
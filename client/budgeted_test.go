@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type usageClient struct {
+	usage Usage
+	calls int
+}
+
+func (c *usageClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	c.calls++
+	return ChatCompletionResponse{
+		Choices: []Choice{{Message: Message{Role: Assistant, Content: "one two three"}}},
+		Usage:   c.usage,
+	}, nil
+}
+
+func TestBudgetedClient(t *testing.T) {
+	backend := &usageClient{usage: Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500}}
+	cl := Budgeted(backend, Budget{
+		Limit:       0.05,
+		Prices:      map[string]Price{"model": {Prompt: 0.02, Completion: 0.04}},
+		CountTokens: countWords,
+	})
+
+	ctx := WithAgentName(context.Background(), "poet")
+	req := ChatCompletionRequest{Model: "model"}
+
+	// Each request costs $0.04, so the first two go through, and the third
+	// one is refused.
+	for i := 0; i < 2; i++ {
+		if _, err := cl.CreateChatCompletion(ctx, req); err != nil {
+			t.Fatalf("request %d: unexpected error: %v", i, err)
+		}
+	}
+	_, err := cl.CreateChatCompletion(ctx, req)
+	var budgetErr *BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a BudgetExceededError, got %v", err)
+	}
+	if backend.calls != 2 {
+		t.Errorf("expected 2 calls to the backend, got %d", backend.calls)
+	}
+
+	total := cl.Total()
+	if total.Requests != 2 || total.PromptTokens != 2000 || total.CompletionTokens != 1000 {
+		t.Errorf("unexpected total: %+v", total)
+	}
+	if got := cl.ByAgent()["poet"].Cost; got < 0.0799 || got > 0.0801 {
+		t.Errorf("expected poet to spend $0.08, got $%f", got)
+	}
+	if got := cl.ByModel()["model"].Requests; got != 2 {
+		t.Errorf("expected 2 requests for model, got %d", got)
+	}
+}
+
+func TestBudgetedClientEstimatesUsage(t *testing.T) {
+	cl := Budgeted(&usageClient{}, Budget{
+		Prices: map[string]Price{"model": {Prompt: 1, Completion: 1}},
+		CountTokens: func(s string) (int, error) {
+			return len(s), nil
+		},
+	})
+
+	req := ChatCompletionRequest{Model: "model", Messages: []Message{{Role: User, Content: "hello"}}}
+	if _, err := cl.CreateChatCompletion(context.Background(), req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	total := cl.Total()
+	if total.PromptTokens != len("hello") || total.CompletionTokens != len("one two three") {
+		t.Errorf("unexpected total: %+v", total)
+	}
+}
+
+func TestBudgetedClientUnknownModel(t *testing.T) {
+	cl := Budgeted(&usageClient{}, Budget{Limit: 1, Prices: map[string]Price{}, CountTokens: countWords})
+	if _, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "unknown"}); err == nil {
+		t.Fatal("expected an error for a model without a price")
+	}
+}
+
+func TestBudgetedClientUnknownModelWithoutLimit(t *testing.T) {
+	backend := &usageClient{usage: Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}}
+	cl := Budgeted(backend, Budget{Prices: map[string]Price{}})
+	if _, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "unknown"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	spent := cl.Total()
+	if spent.Requests != 1 || spent.PromptTokens != 10 || spent.Cost != 0 {
+		t.Errorf("unexpected total: %+v", spent)
+	}
+}
+
+func TestBudgetedClientLimitNeedsCountTokens(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a limit without CountTokens")
+		}
+	}()
+	// Streamed requests report no usage, so they would be tracked as free
+	// and the limit would never be reached.
+	Budgeted(&usageClient{}, Budget{Limit: 1, Prices: map[string]Price{"model": {Prompt: 1}}})
+}
+
+func TestBudgetedClientStreams(t *testing.T) {
+	inner := streamingAnswering{funcClient: answering("unused"), content: "one two three"}
+	cl := Budgeted(inner, Budget{
+		Limit:       0.004,
+		Prices:      map[string]Price{"model": {Prompt: 1, Completion: 1}},
+		CountTokens: countWords,
+	})
+	ctx := context.Background()
+	req := ChatCompletionRequest{Model: "model", Messages: []Message{{Role: User, Content: "hello"}}}
+
+	// The stream reports no usage, so it is estimated at EOF.
+	stream, err := cl.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := CollectStream(stream, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total := cl.Total(); total.Requests != 1 || total.PromptTokens != 1 || total.CompletionTokens != 3 {
+		t.Errorf("unexpected total: %+v", total)
+	}
+
+	// The budget is spent, so the next stream is refused before it is opened.
+	_, err = cl.CreateChatCompletionStream(ctx, req)
+	var budgetErr *BudgetExceededError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a BudgetExceededError, got %v", err)
+	}
+}
+
+func TestBudgetedClientChargesStreamsClosedEarly(t *testing.T) {
+	inner := streamingAnswering{funcClient: answering("unused"), content: "one two three"}
+	cl := Budgeted(inner, Budget{
+		Prices:      map[string]Price{"model": {Prompt: 1, Completion: 1}},
+		CountTokens: countWords,
+	})
+	stream, err := cl.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "model"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stream.Close()
+	stream.Close()
+	if total := cl.Total(); total.Requests != 1 || total.CompletionTokens != 1 {
+		t.Errorf("unexpected total: %+v", total)
+	}
+}
@@ -1,12 +1,20 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/ryszard/agency/util/trace"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,17 +27,129 @@ type Cache interface {
 	Set(key []byte, value []byte) error
 }
 
+// ExtendedCache is a Cache that also supports expiration, deletion and
+// iteration. The caches in util/cache implement it.
+type ExtendedCache interface {
+	Cache
+	// SetWithTTL is like Set, but the value expires after ttl. If ttl is
+	// zero, it never expires.
+	SetWithTTL(key []byte, value []byte, ttl time.Duration) error
+	// Delete removes the value for key, if there is one.
+	Delete(key []byte) error
+	// Range calls fn for every entry that hasn't expired, until fn returns
+	// false.
+	Range(fn func(key, value []byte) bool) error
+}
+
+// CacheOption configures Cached.
+type CacheOption func(*CachedClient)
+
+// CacheTTL makes the cached responses expire after ttl. The cache has to be
+// an ExtendedCache.
+func CacheTTL(ttl time.Duration) CacheOption {
+	return func(c *CachedClient) {
+		c.ttl = ttl
+	}
+}
+
+// CacheKeyFunc returns the key under which the response to req is cached.
+type CacheKeyFunc func(req ChatCompletionRequest) ([]byte, error)
+
+// CacheKey sets the function computing the cache keys. By default, the key
+// is a hash of the whole request (except Stream and Priority).
+func CacheKey(fn CacheKeyFunc) CacheOption {
+	return func(c *CachedClient) {
+		c.keyFunc = fn
+	}
+}
+
+// IgnoreParams excludes request fields and custom parameters from the
+// default cache key, so that requests that differ only in them share the
+// cached response. Names are the JSON names of the fields of
+// ChatCompletionRequest (like "user" or "max_tokens") or keys of
+// CustomParams. Requests that have none of them keep the key they would have
+// without IgnoreParams. It has no effect together with CacheKey.
+func IgnoreParams(names ...string) CacheOption {
+	return func(c *CachedClient) {
+		c.ignored = append(c.ignored, names...)
+	}
+}
+
+// CacheNamespace prefixes the cache keys with namespace, like "prompts-v2".
+// Changing the namespace, for example when the prompts change, makes the
+// responses cached under the old one unused; they can be removed with
+// Invalidate.
+func CacheNamespace(namespace string) CacheOption {
+	return func(c *CachedClient) {
+		c.namespace = namespace
+	}
+}
+
+// CacheIf makes CachedClient cache only the requests for which cond returns
+// true. Other requests go straight to the wrapped client, without looking
+// in the cache. See Deterministic.
+func CacheIf(cond func(req ChatCompletionRequest) bool) CacheOption {
+	return func(c *CachedClient) {
+		c.cond = cond
+	}
+}
+
+// Deterministic returns true if req sets its temperature to 0, so that
+// caching the response doesn't hide the variety of sampling. Requests that
+// don't set it get the provider's default, so they are not deterministic.
+// It's meant to be used with CacheIf.
+func Deterministic(req ChatCompletionRequest) bool {
+	return req.Temperature != nil && *req.Temperature == 0
+}
+
+// ReplayChunks makes cache hits stream their content in chunks of size
+// characters (runes), waiting delay between chunks, so that cached runs look
+// like live ones. By default the whole content is written at once.
+func ReplayChunks(size int, delay time.Duration) CacheOption {
+	return func(c *CachedClient) {
+		c.chunkSize = size
+		c.chunkDelay = delay
+	}
+}
+
 type CachedClient struct {
-	client Client
-	cache  Cache
+	client     Client
+	cache      Cache
+	ttl        time.Duration
+	chunkSize  int
+	chunkDelay time.Duration
+	keyFunc    CacheKeyFunc
+	ignored    []string
+	namespace  string
+	cond       func(req ChatCompletionRequest) bool
+
+	mu      sync.Mutex
+	flights map[string]*flight
 }
 
-// Cached wraps a client with a cache.
-func Cached(client Client, cache Cache) *CachedClient {
-	return &CachedClient{
+// Cached wraps a client with a cache. By default every request is cached,
+// under a hash of the whole request; opts can change the key, which requests
+// are cached and for how long.
+func Cached(client Client, cache Cache, opts ...CacheOption) *CachedClient {
+	c := &CachedClient{
 		client: client,
 		cache:  cache,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if _, ok := cache.(ExtendedCache); c.ttl > 0 && !ok {
+		panic("CacheTTL requires an ExtendedCache")
+	}
+	return c
+}
+
+// set stores val in the cache, with the configured TTL if there is one.
+func (c *CachedClient) set(key, val []byte) error {
+	if c.ttl > 0 {
+		return c.cache.(ExtendedCache).SetWithTTL(key, val, c.ttl)
+	}
+	return c.cache.Set(key, val)
 }
 func hash(r any) ([]byte, error) {
 	data, err := json.Marshal(r)
@@ -43,44 +163,429 @@ func hash(r any) ([]byte, error) {
 
 }
 
-// CreateChatCompletion implements Client
+// hashIgnoring is like hash, but without the given fields and custom
+// parameters of req. The ignored fields are zeroed rather than removed, so
+// that requests that don't have them get the same key as with hash.
+func hashIgnoring(req ChatCompletionRequest, ignored []string) ([]byte, error) {
+	v := reflect.ValueOf(&req).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if containsString(ignored, name) {
+			v.Field(i).Set(reflect.Zero(v.Field(i).Type()))
+		}
+	}
+
+	var params map[string]interface{}
+	deleted := false
+	for key, value := range req.CustomParams {
+		if containsString(ignored, key) {
+			deleted = true
+			continue
+		}
+		if params == nil {
+			params = make(map[string]interface{})
+		}
+		params[key] = value
+	}
+	if deleted {
+		// Without the ignored ones, there may be no parameters left, as if
+		// there were none to begin with.
+		req.CustomParams = params
+	}
+	return hash(req)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the cache key for req.
+func (c *CachedClient) key(req ChatCompletionRequest) ([]byte, error) {
+	var key []byte
+	var err error
+	switch {
+	case c.keyFunc != nil:
+		key, err = c.keyFunc(req)
+	case len(c.ignored) > 0:
+		key, err = hashIgnoring(req, c.ignored)
+	default:
+		key, err = hash(req)
+	}
+	if err != nil || c.namespace == "" {
+		return key, err
+	}
+	return append([]byte(c.namespace+"/"), key...), nil
+}
+
+// Invalidate removes the responses cached under namespace (see
+// CacheNamespace), returning how many there were. The cache has to be an
+// ExtendedCache.
+func (c *CachedClient) Invalidate(namespace string) (int, error) {
+	cache, ok := c.cache.(ExtendedCache)
+	if !ok {
+		return 0, fmt.Errorf("invalidating %q: the cache doesn't support deletion", namespace)
+	}
+	prefix := []byte(namespace + "/")
+	var keys [][]byte
+	err := cache.Range(func(key, value []byte) bool {
+		if bytes.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := cache.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	log.WithField("namespace", namespace).WithField("removed", len(keys)).Debug("invalidated cached responses")
+	return len(keys), nil
+}
+
+// flight is a request being sent to the wrapped client, which identical
+// requests wait for instead of sending their own.
+type flight struct {
+	done chan struct{}
+	// val is the marshaled response, if err is nil.
+	val []byte
+	err error
+}
+
+// CreateChatCompletion implements Client. Concurrent identical requests are
+// coalesced: only one of them is sent to the wrapped client on a cache miss,
+// and the others wait for its response, which they get as a cache hit.
 func (c *CachedClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
-	hash, err := hash(req)
+	if c.cond != nil && !c.cond(req) {
+		log.Debug("request not cacheable")
+		return c.client.CreateChatCompletion(ctx, req)
+	}
+	hash, err := c.key(req)
 	log.WithField("hash", fmt.Sprintf("%x", hash)).Debug("hashing request")
 	if err != nil {
 		return ChatCompletionResponse{}, err
 	}
+	key := string(hash)
+
+	for {
+		c.mu.Lock()
+		if f, ok := c.flights[key]; ok {
+			c.mu.Unlock()
+			log.Debug("waiting for identical request in flight")
+			select {
+			case <-ctx.Done():
+				return ChatCompletionResponse{}, ctx.Err()
+			case <-f.done:
+			}
+			if f.err != nil {
+				if errors.Is(f.err, context.Canceled) || errors.Is(f.err, context.DeadlineExceeded) {
+					// It was the context of the other request that was
+					// done, not ours, so try again.
+					continue
+				}
+				return ChatCompletionResponse{}, f.err
+			}
+			trace.FromContext(ctx).SetAttribute("cache_hit", true)
+			return c.hit(ctx, req, f.val)
+		}
+		f := &flight{done: make(chan struct{})}
+		if c.flights == nil {
+			c.flights = make(map[string]*flight)
+		}
+		c.flights[key] = f
+		c.mu.Unlock()
+
+		resp, hit, err := c.lead(ctx, key, hash, req, f)
+		if hit {
+			return c.hit(ctx, req, f.val)
+		}
+		return resp, err
+	}
+}
+
+// errFlightPanicked is what the requests waiting for a flight get if the
+// wrapped client panicked.
+var errFlightPanicked = errors.New("cached: the identical request in flight panicked")
+
+// lead looks up req for the flight f, and then completes the flight, even if
+// the wrapped client panics, so that the requests waiting for it don't block
+// forever.
+func (c *CachedClient) lead(ctx context.Context, key string, hash []byte, req ChatCompletionRequest, f *flight) (resp ChatCompletionResponse, hit bool, err error) {
+	// Replaced once lookup returns normally.
+	f.err = errFlightPanicked
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	resp, f.val, hit, err = c.lookup(ctx, hash, req)
+	f.err = err
+	return resp, hit, err
+}
+
+// cacheEntry is what CachedClient stores in the cache: the response, and how
+// it was streamed, so that it can be replayed faithfully.
+type cacheEntry struct {
+	ChatCompletionResponse
+	// Streamed is what the wrapped client wrote to
+	// ChatCompletionRequest.Stream, if it was set.
+	Streamed *string `json:"streamed,omitempty"`
+	// Events are the events of the response, if it came from
+	// CreateChatCompletionStream.
+	Events []StreamEvent `json:"events,omitempty"`
+}
+
+// hit returns the response stored in val, writing it to req.Stream if it is
+// set.
+func (c *CachedClient) hit(ctx context.Context, req ChatCompletionRequest, val []byte) (ChatCompletionResponse, error) {
+	var entry cacheEntry
+	if err := json.Unmarshal(val, &entry); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	if req.Stream != nil {
+		if err := c.replayTo(ctx, req.Stream, entry); err != nil {
+			return ChatCompletionResponse{}, err
+		}
+	}
+	resp := entry.ChatCompletionResponse
+	resp.SetMetadata(MetadataCache, "hit")
+	return resp, nil
+}
 
+// replayTo writes the streamed content of entry to w, in chunks if
+// ReplayChunks was used.
+func (c *CachedClient) replayTo(ctx context.Context, w io.Writer, entry cacheEntry) error {
+	var content string
+	switch {
+	case entry.Streamed != nil:
+		content = *entry.Streamed
+	case len(entry.Choices) > 0:
+		content = entry.Choices[0].Content
+	}
+	for i, chunk := range chunks(content, c.chunkSize) {
+		if i > 0 {
+			if err := sleep(ctx, c.chunkDelay); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup returns the cached response for req, or gets it from the wrapped
+// client and caches it. It also returns the marshaled cache entry, and
+// whether it was a hit, in which case the response is left to hit.
+func (c *CachedClient) lookup(ctx context.Context, hash []byte, req ChatCompletionRequest) (resp ChatCompletionResponse, val []byte, hit bool, err error) {
 	val, ok, err := c.cache.Get(hash)
 	if err != nil {
-		return ChatCompletionResponse{}, err
+		return ChatCompletionResponse{}, nil, false, err
 	}
 
+	trace.FromContext(ctx).SetAttribute("cache_hit", ok)
 	if ok {
 		log.Debug("cache hit")
-		var resp ChatCompletionResponse
-		if err := json.Unmarshal(val, &resp); err != nil {
-			return ChatCompletionResponse{}, err
-		}
-		return resp, nil
+		return ChatCompletionResponse{}, val, true, nil
 	}
 	log.Debug("cache miss")
-	resp, err := c.client.CreateChatCompletion(ctx, req)
+	var streamed *strings.Builder
+	if req.Stream != nil {
+		streamed = &strings.Builder{}
+		req.Stream = io.MultiWriter(req.Stream, streamed)
+	}
+	resp, err = c.client.CreateChatCompletion(ctx, req)
 	if err != nil {
-		return ChatCompletionResponse{}, err
+		return ChatCompletionResponse{}, nil, false, err
 	}
 
-	val, err = json.Marshal(resp)
+	entry := cacheEntry{ChatCompletionResponse: resp}
+	if streamed != nil {
+		s := streamed.String()
+		entry.Streamed = &s
+	}
+	val, err = json.Marshal(entry)
 	if err != nil {
-		return ChatCompletionResponse{}, err
+		return ChatCompletionResponse{}, nil, false, err
 	}
 	log.Debug("setting cache")
-	if err := c.cache.Set(hash, val); err != nil {
-		return ChatCompletionResponse{}, err
+	if err := c.set(hash, val); err != nil {
+		return ChatCompletionResponse{}, nil, false, err
 	}
 
-	return resp, nil
+	resp.SetMetadata(MetadataCache, "miss")
+	return resp, val, false, nil
+}
 
+// CreateChatCompletionStream implements StreamingClient. On a hit, the
+// events of the cached response are replayed, paced as set by ReplayChunks;
+// if it was not streamed when cached, events are made from it. On a miss, the
+// stream is cached once it is read to the end. Identical streams are not
+// coalesced.
+func (c *CachedClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := c.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	if c.cond != nil && !c.cond(req) {
+		log.Debug("request not cacheable")
+		return streaming.CreateChatCompletionStream(ctx, req)
+	}
+	hash, err := c.key(req)
+	if err != nil {
+		return nil, err
+	}
+	val, ok, err := c.cache.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	trace.FromContext(ctx).SetAttribute("cache_hit", ok)
+	if ok {
+		log.Debug("cache hit")
+		var entry cacheEntry
+		if err := json.Unmarshal(val, &entry); err != nil {
+			return nil, err
+		}
+		return &cachedStream{ctx: ctx, events: c.events(entry), delay: c.chunkDelay}, nil
+	}
+	log.Debug("cache miss")
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingStream{ChatCompletionStream: stream, client: c, hash: hash}, nil
+}
+
+// events returns the events to replay for entry.
+func (c *CachedClient) events(entry cacheEntry) []StreamEvent {
+	if entry.Events != nil {
+		return entry.Events
+	}
+	var events []StreamEvent
+	if len(entry.Choices) == 0 {
+		return events
+	}
+	choice := entry.Choices[0]
+	for _, chunk := range chunks(choice.Content, c.chunkSize) {
+		events = append(events, StreamEvent{Content: chunk})
+	}
+	last := StreamEvent{FinishReason: choice.FinishReason}
+	for i, call := range choice.ToolCalls {
+		last.ToolCalls = append(last.ToolCalls, ToolCallDelta{Index: i, ID: call.ID, Name: call.Name, Arguments: call.Arguments})
+	}
+	if entry.Usage != (Usage{}) {
+		usage := entry.Usage
+		last.Usage = &usage
+	}
+	return append(events, last)
+}
+
+// cachedStream replays cached events, waiting delay between them.
+type cachedStream struct {
+	ctx    context.Context
+	events []StreamEvent
+	delay  time.Duration
+	sent   bool
+}
+
+func (s *cachedStream) Recv() (StreamEvent, error) {
+	if len(s.events) == 0 {
+		return StreamEvent{}, io.EOF
+	}
+	if s.sent {
+		if err := sleep(s.ctx, s.delay); err != nil {
+			return StreamEvent{}, err
+		}
+	}
+	s.sent = true
+	event := s.events[0]
+	s.events = s.events[1:]
+	return event, nil
+}
+
+func (s *cachedStream) Close() error {
+	s.events = nil
+	return nil
+}
+
+// cachingStream caches the events of a stream when it reaches the end.
+type cachingStream struct {
+	ChatCompletionStream
+	client *CachedClient
+	hash   []byte
+	acc    StreamAccumulator
+	events []StreamEvent
+}
+
+func (s *cachingStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err == nil {
+		s.acc.Add(event)
+		s.events = append(s.events, event)
+		return event, nil
+	}
+	if err == io.EOF && s.hash != nil {
+		entry := cacheEntry{ChatCompletionResponse: s.acc.Response(), Events: s.events}
+		// Only the first EOF caches the stream.
+		hash := s.hash
+		s.hash = nil
+		val, merr := json.Marshal(entry)
+		if merr != nil {
+			return StreamEvent{}, merr
+		}
+		log.Debug("setting cache")
+		if serr := s.client.set(hash, val); serr != nil {
+			return StreamEvent{}, serr
+		}
+	}
+	return event, err
+}
+
+// Unwrap implements Wrapper.
+func (c *CachedClient) Unwrap() Client {
+	return c.client
+}
+
+// chunks splits s in chunks of at most n runes. If n isn't positive, s is
+// not split.
+func chunks(s string, n int) []string {
+	if s == "" {
+		return nil
+	}
+	if n <= 0 {
+		return []string{s}
+	}
+	var out []string
+	runes := []rune(s)
+	for len(runes) > n {
+		out = append(out, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return append(out, string(runes))
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
-var _ Client = (*CachedClient)(nil)
+var _ StreamingClient = (*CachedClient)(nil)
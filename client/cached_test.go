@@ -2,9 +2,15 @@ package client
 
 import (
 	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ryszard/agency/util/cache"
+	"github.com/stretchr/testify/assert"
 )
 
 type mockClient struct {
@@ -74,3 +80,339 @@ func TestCachedClient(t *testing.T) {
 		t.Fatalf("Expected cache to be hit on second request")
 	}
 }
+
+func TestCachedClientCoalescesConcurrentRequests(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	cl := Cached(funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return answering("shared")(ctx, req)
+	}), cache.Memory())
+
+	const n = 10
+	var wg sync.WaitGroup
+	responses := make([]ChatCompletionResponse, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+			assert.NoError(t, err)
+			responses[i] = resp
+		}(i)
+	}
+	// Give the requests time to pile up behind the first one.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	misses := 0
+	for _, resp := range responses {
+		assert.Equal(t, "shared:m", resp.Choices[0].Content)
+		if resp.Metadata[MetadataCache] == "miss" {
+			misses++
+		}
+	}
+	assert.Equal(t, 1, misses)
+}
+
+func TestCachedClientRetriesWhenTheLeaderIsCanceled(t *testing.T) {
+	started := make(chan struct{}, 2)
+	cl := Cached(funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		started <- struct{}{}
+		if AgentName(ctx) == "impatient" {
+			<-ctx.Done()
+			return ChatCompletionResponse{}, ctx.Err()
+		}
+		return answering("patient")(ctx, req)
+	}), cache.Memory())
+
+	ctx, cancel := context.WithCancel(WithAgentName(context.Background(), "impatient"))
+	leaderDone := make(chan error)
+	go func() {
+		_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m"})
+		leaderDone <- err
+	}()
+	<-started
+
+	followerDone := make(chan ChatCompletionResponse)
+	go func() {
+		resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+		assert.NoError(t, err)
+		followerDone <- resp
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-leaderDone, context.Canceled)
+	assert.Equal(t, "patient:m", (<-followerDone).Choices[0].Content)
+}
+
+var (
+	_ ExtendedCache = cache.Memory()
+	_ ExtendedCache = (*cache.BoltDBCache)(nil)
+)
+
+func TestCachedClientTTL(t *testing.T) {
+	var calls int
+	cl := Cached(funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		calls++
+		return answering("x")(ctx, req)
+	}), cache.Memory(), CacheTTL(10*time.Millisecond))
+
+	for i := 0; i < 2; i++ {
+		_, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, calls)
+	time.Sleep(20 * time.Millisecond)
+	_, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	assert.Panics(t, func() { Cached(answering("x"), &mockCache{cache: cache.Memory()}, CacheTTL(time.Second)) })
+}
+
+// countingClient counts the requests it answers.
+func countingClient(calls *int) funcClient {
+	return func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		*calls++
+		return answering("x")(ctx, req)
+	}
+}
+
+func TestCachedClientIgnoreParams(t *testing.T) {
+	var calls int
+	cl := Cached(countingClient(&calls), cache.Memory(), IgnoreParams("user", "trace_id"))
+	ctx := context.Background()
+	for _, req := range []ChatCompletionRequest{
+		{Model: "m", User: "alice", CustomParams: map[string]any{"trace_id": 1}},
+		{Model: "m", User: "bob", CustomParams: map[string]any{"trace_id": 2}},
+		{Model: "m"},
+	} {
+		_, err := cl.CreateChatCompletion(ctx, req)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, calls)
+
+	_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m", CustomParams: map[string]any{"other": 1}})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestIgnoreParamsKeepsOtherKeys(t *testing.T) {
+	plain := Cached(answering("x"), cache.Memory())
+	ignoring := Cached(answering("x"), cache.Memory(), IgnoreParams("user", "trace_id"))
+	temp := float32(0.5)
+	for _, req := range []ChatCompletionRequest{
+		{Model: "m", Messages: []Message{{Role: User, Content: "hi"}}, TopP: &temp},
+		{Model: "m", CustomParams: map[string]any{"other": 1}},
+		{Model: "m", CustomParams: map[string]any{}},
+	} {
+		want, err := plain.key(req)
+		assert.NoError(t, err)
+		got, err := ignoring.key(req)
+		assert.NoError(t, err)
+		assert.Equal(t, string(want), string(got), "%+v", req)
+	}
+
+	// The ignored ones don't change the key.
+	want, _ := plain.key(ChatCompletionRequest{Model: "m", CustomParams: map[string]any{"other": 1}})
+	got, _ := ignoring.key(ChatCompletionRequest{Model: "m", User: "alice", CustomParams: map[string]any{"other": 1, "trace_id": "t"}})
+	assert.Equal(t, string(want), string(got))
+}
+
+func TestCachedClientCacheIf(t *testing.T) {
+	var calls int
+	cl := Cached(countingClient(&calls), cache.Memory(), CacheIf(Deterministic))
+	ctx := context.Background()
+	zero, high := float32(0), float32(0.7)
+	for i := 0; i < 2; i++ {
+		_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Temperature: &high})
+		assert.NoError(t, err)
+		_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{Temperature: &zero})
+		assert.NoError(t, err)
+		// Without a temperature, the provider's default is used.
+		_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "unset"})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 5, calls)
+}
+
+func TestCachedClientNamespaces(t *testing.T) {
+	var calls int
+	store := cache.Memory()
+	ctx := context.Background()
+	v1 := Cached(countingClient(&calls), store, CacheNamespace("v1"))
+	v2 := Cached(countingClient(&calls), store, CacheNamespace("v2"))
+	for _, cl := range []*CachedClient{v1, v2, v1, v2} {
+		_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, calls)
+
+	removed, err := v2.Invalidate("v1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 1, store.Len())
+
+	_, err = v1.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	_, err = Cached(countingClient(&calls), &mockCache{cache: store}).Invalidate("v1")
+	assert.Error(t, err)
+}
+
+func TestCachedClientCustomKey(t *testing.T) {
+	var calls int
+	byModel := func(req ChatCompletionRequest) ([]byte, error) { return []byte(req.Model), nil }
+	cl := Cached(countingClient(&calls), cache.Memory(), CacheKey(byModel))
+	ctx := context.Background()
+	for _, content := range []string{"a", "b"} {
+		_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m", Messages: []Message{{Content: content}}})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+// chunkWriter records the writes made to it.
+type chunkWriter struct {
+	writes []string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestCachedClientReplaysToStream(t *testing.T) {
+	var calls int
+	live := funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		calls++
+		if req.Stream != nil {
+			req.Stream.Write([]byte("Hello there"))
+			req.Stream.Write([]byte("\n\n"))
+		}
+		return ChatCompletionResponse{Choices: []Choice{{Message: Message{Role: Assistant, Content: "Hello there"}}}}, nil
+	})
+	ctx := context.Background()
+	cl := Cached(live, cache.Memory(), ReplayChunks(5, time.Millisecond))
+
+	missed := &chunkWriter{}
+	_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "streamed", Stream: missed})
+	assert.NoError(t, err)
+	hit := &chunkWriter{}
+	resp, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "streamed", Stream: hit})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "hit", resp.Metadata[MetadataCache])
+	assert.Equal(t, strings.Join(missed.writes, ""), strings.Join(hit.writes, ""))
+	assert.Equal(t, []string{"Hello", " ther", "e\n\n"}, hit.writes)
+
+	// A response cached without streaming is written as its content.
+	_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "plain"})
+	assert.NoError(t, err)
+	var sb strings.Builder
+	_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "plain", Stream: &sb})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello there", sb.String())
+	assert.Equal(t, 2, calls)
+}
+
+func TestCachedClientCachesStreams(t *testing.T) {
+	var calls int
+	inner := streamingAnswering{funcClient: countingClient(&calls), content: "one two three"}
+	ctx := context.Background()
+	cl := Cached(inner, cache.Memory())
+
+	collect := func() []StreamEvent {
+		stream, err := cl.CreateChatCompletionStream(ctx, ChatCompletionRequest{Model: "m"})
+		assert.NoError(t, err)
+		defer stream.Close()
+		var events []StreamEvent
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				assert.ErrorIs(t, err, io.EOF)
+				return events
+			}
+			events = append(events, event)
+		}
+	}
+	live := collect()
+	cached := collect()
+	assert.Len(t, live, 3)
+	assert.Equal(t, live, cached)
+
+	// The streamed response also serves requests that don't stream.
+	resp, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "one two three", resp.Choices[0].Content)
+	assert.Equal(t, FinishReasonStop, resp.Choices[0].FinishReason)
+	assert.Equal(t, 0, calls)
+}
+
+func TestCachedClientStreamsNonStreamedResponses(t *testing.T) {
+	var calls int
+	inner := streamingAnswering{funcClient: countingClient(&calls), content: "unused"}
+	cl := Cached(inner, cache.Memory(), ReplayChunks(2, 0))
+	ctx := context.Background()
+
+	_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	stream, err := cl.CreateChatCompletionStream(ctx, ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	first, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "x:", first.Content)
+	resp, err := CollectStream(stream, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "m", resp.Choices[0].Content)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCachedClientRecoversFromPanickingLeader(t *testing.T) {
+	release := make(chan struct{})
+	panicking := true
+	cl := Cached(funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		if panicking {
+			<-release
+			panic("boom")
+		}
+		return answering("fine")(ctx, req)
+	}), cache.Memory())
+
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		defer func() { recover() }()
+		cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+	}()
+	// Wait for the leader to be in flight.
+	for {
+		cl.mu.Lock()
+		n := len(cl.flights)
+		cl.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	followerErr := make(chan error)
+	go func() {
+		_, err := cl.CreateChatCompletion(quickly(t), ChatCompletionRequest{Model: "m"})
+		followerErr <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	close(release)
+	<-leaderDone
+	assert.ErrorIs(t, <-followerErr, errFlightPanicked)
+
+	panicking = false
+	resp, err := cl.CreateChatCompletion(quickly(t), ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	assert.Equal(t, "fine:m", resp.Choices[0].Content)
+}
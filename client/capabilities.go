@@ -0,0 +1,95 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrUnsupported is wrapped by the errors returned by Validate.
+var ErrUnsupported = errors.New("unsupported")
+
+// Capabilities describes what a client supports. Clients should implement it,
+// so that requests can be validated before being sent (see Validate).
+type Capabilities interface {
+	// SupportsStreaming returns true if the client can stream responses as
+	// they are generated. Clients that don't support streaming still write
+	// the whole message to ChatCompletionRequest.Stream.
+	SupportsStreaming() bool
+	// SupportsTools returns true if the client supports tool calling.
+	SupportsTools() bool
+	// SupportsImages returns true if the client supports image content
+	// parts.
+	SupportsImages() bool
+	// SupportedParameters returns the keys of CustomParams that the client
+	// understands, together with the types their values must have.
+	SupportedParameters() map[string]reflect.Type
+	// MaxContextTokens returns the size of the context window of a model,
+	// in tokens. ok is false if the model is unknown.
+	MaxContextTokens(model string) (tokens int, ok bool)
+}
+
+// Wrapper is implemented by clients that wrap another client, like the ones
+// returned by Retrying or Cached.
+type Wrapper interface {
+	Unwrap() Client
+}
+
+// CapabilitiesOf returns the Capabilities of cl. If cl doesn't implement
+// Capabilities but is a Wrapper, the wrapped clients are checked.
+func CapabilitiesOf(cl Client) (Capabilities, bool) {
+	for cl != nil {
+		if caps, ok := cl.(Capabilities); ok {
+			return caps, true
+		}
+		wrapper, ok := cl.(Wrapper)
+		if !ok {
+			break
+		}
+		cl = wrapper.Unwrap()
+	}
+	return nil, false
+}
+
+// AnyParameter can be used as a key in the map returned by
+// Capabilities.SupportedParameters to accept custom params that are not
+// listed, with values of the given type, or of any type if it is nil. It is
+// meant for clients that pass the params through without knowing them, like
+// test fakes.
+const AnyParameter = "*"
+
+// Validate checks whether req can be handled by a client with the given
+// capabilities. The returned error wraps ErrUnsupported.
+func Validate(caps Capabilities, req ChatCompletionRequest) error {
+	if (len(req.Tools) > 0 || req.ToolChoice != "") && !caps.SupportsTools() {
+		return fmt.Errorf("%w: tools", ErrUnsupported)
+	}
+
+	if !caps.SupportsImages() {
+		for _, msg := range req.Messages {
+			if msg.HasImages() {
+				return fmt.Errorf("%w: images", ErrUnsupported)
+			}
+		}
+	}
+
+	params := caps.SupportedParameters()
+	for key, value := range req.CustomParams {
+		typ, ok := params[key]
+		if !ok {
+			typ, ok = params[AnyParameter]
+		}
+		if !ok {
+			return fmt.Errorf("%w: custom param %q", ErrUnsupported, key)
+		}
+		if typ != nil && reflect.TypeOf(value) != typ {
+			return fmt.Errorf("%w: custom param %q must be a %v, got %T", ErrUnsupported, key, typ, value)
+		}
+	}
+
+	if max, ok := caps.MaxContextTokens(req.Model); ok && req.MaxTokens > max {
+		return fmt.Errorf("%w: max tokens %d exceed the context of model %q (%d)", ErrUnsupported, req.MaxTokens, req.Model, max)
+	}
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type capableClient struct {
+	mockClient
+}
+
+func (capableClient) SupportsStreaming() bool { return false }
+func (capableClient) SupportsTools() bool     { return false }
+func (capableClient) SupportsImages() bool    { return false }
+
+func (capableClient) SupportedParameters() map[string]reflect.Type {
+	return map[string]reflect.Type{"top_k": reflect.TypeOf(0)}
+}
+
+func (capableClient) MaxContextTokens(model string) (int, bool) {
+	if model == "small" {
+		return 100, true
+	}
+	return 0, false
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		req  ChatCompletionRequest
+		ok   bool
+	}{
+		{
+			name: "ok",
+			req:  ChatCompletionRequest{Model: "small", MaxTokens: 100, CustomParams: map[string]interface{}{"top_k": 10}},
+			ok:   true,
+		},
+		{
+			name: "misspelled param",
+			req:  ChatCompletionRequest{CustomParams: map[string]interface{}{"topk": 10}},
+		},
+		{
+			name: "param with wrong type",
+			req:  ChatCompletionRequest{CustomParams: map[string]interface{}{"top_k": 10.0}},
+		},
+		{
+			name: "tools",
+			req:  ChatCompletionRequest{Tools: []ToolDefinition{{Name: "bash"}}},
+		},
+		{
+			name: "images",
+			req:  ChatCompletionRequest{Messages: []Message{{Role: User, Parts: []ContentPart{ImageURLPart("https://example.com/cat.png")}}}},
+		},
+		{
+			name: "max tokens exceed context",
+			req:  ChatCompletionRequest{Model: "small", MaxTokens: 101},
+		},
+		{
+			name: "unknown model",
+			req:  ChatCompletionRequest{Model: "unknown", MaxTokens: 1000000},
+			ok:   true,
+		},
+	} {
+		err := Validate(capableClient{}, tc.req)
+		if tc.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		} else if !tc.ok && !errors.Is(err, ErrUnsupported) {
+			t.Errorf("%s: expected ErrUnsupported, got %v", tc.name, err)
+		}
+	}
+}
+
+// passThroughClient accepts any custom params, and top_k only as an int.
+type passThroughClient struct{ capableClient }
+
+func (passThroughClient) SupportedParameters() map[string]reflect.Type {
+	return map[string]reflect.Type{AnyParameter: nil, "top_k": reflect.TypeOf(0)}
+}
+
+func TestValidateAnyParameter(t *testing.T) {
+	if err := Validate(passThroughClient{}, ChatCompletionRequest{CustomParams: map[string]interface{}{"whatever": []string{"x"}, "top_k": 1}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := Validate(passThroughClient{}, ChatCompletionRequest{CustomParams: map[string]interface{}{"top_k": "1"}}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+}
+
+func TestCapabilitiesOf(t *testing.T) {
+	var cl Client = Retrying(&capableClient{}, time.Second, time.Second, 1)
+	cl = Cached(cl, nil)
+	if _, ok := CapabilitiesOf(cl); !ok {
+		t.Error("expected to find capabilities of the wrapped client")
+	}
+
+	if _, ok := CapabilitiesOf(Cached(&mockClient{}, nil)); ok {
+		t.Error("expected mockClient to have no capabilities")
+	}
+}
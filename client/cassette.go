@@ -0,0 +1,399 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Interaction is a request and what the client answered, as stored in a
+// cassette by Recording. A cassette is a file with one Interaction per line,
+// encoded as JSON.
+type Interaction struct {
+	Request ChatCompletionRequest `json:"request"`
+	// Stream is true if the request was made with
+	// CreateChatCompletionStream.
+	Stream bool `json:"stream,omitempty"`
+
+	Response *ChatCompletionResponse `json:"response,omitempty"`
+	// Streamed is the content written to Request.Stream, if it was set.
+	Streamed string `json:"streamed,omitempty"`
+	// Events are the events of the stream, if Stream is true.
+	Events []StreamEvent `json:"events,omitempty"`
+
+	// Error is the message of the error returned by the client, if any, and
+	// ErrorClass its class (see ErrorClass), so that rate limits and
+	// retryable errors can be replayed as such.
+	Error      string `json:"error,omitempty"`
+	ErrorClass string `json:"error_class,omitempty"`
+}
+
+// canonicalRequest returns a representation of req that doesn't depend on
+// whether it was read back from a cassette.
+func canonicalRequest(req ChatCompletionRequest) (string, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	// Going through a generic value sorts the keys of anything that was a
+	// struct before being decoded as a map, like the tool parameters.
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+	data, err = json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+type recordingClient struct {
+	client Client
+	path   string
+
+	mu sync.Mutex
+}
+
+// Recording wraps a Client and appends every request it makes, together with
+// the response or error, to the cassette at path, creating it if needed. The
+// cassette can be served back with Replaying, which makes tests that talk to
+// a real provider deterministic and able to run offline. Cassettes are JSON
+// lines, so they can be read and reviewed like any other test data.
+func Recording(client Client, path string) Client {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	return &recordingClient{
+		client: client,
+		path:   path,
+	}
+}
+
+// record appends interaction to the cassette.
+func (client *recordingClient) record(interaction Interaction, err error) error {
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.ErrorClass = ErrorClass(err)
+	}
+	data, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	f, err := os.OpenFile(client.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (client *recordingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	var streamed bytes.Buffer
+	sent := req
+	if req.Stream != nil {
+		sent.Stream = io.MultiWriter(req.Stream, &streamed)
+	}
+	resp, err := client.client.CreateChatCompletion(ctx, sent)
+
+	interaction := Interaction{Request: req, Streamed: streamed.String()}
+	if err == nil {
+		interaction.Response = &resp
+	}
+	if recErr := client.record(interaction, err); recErr != nil {
+		log.WithError(recErr).WithField("path", client.path).Error("Recording: failed to write the cassette")
+		return ChatCompletionResponse{}, fmt.Errorf("recording: %w", recErr)
+	}
+	return resp, err
+}
+
+// CreateChatCompletionStream implements StreamingClient. The interaction is
+// written to the cassette when the stream ends or is closed.
+func (client *recordingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		if recErr := client.record(Interaction{Request: req, Stream: true}, err); recErr != nil {
+			log.WithError(recErr).WithField("path", client.path).Error("Recording: failed to write the cassette")
+		}
+		return nil, err
+	}
+	return &recordingStream{
+		ChatCompletionStream: stream,
+		client:               client,
+		interaction:          Interaction{Request: req, Stream: true},
+	}, nil
+}
+
+// recordingStream records the events of a stream, and writes them to the
+// cassette once, when the stream ends or is closed.
+type recordingStream struct {
+	ChatCompletionStream
+	client      *recordingClient
+	interaction Interaction
+	recorded    bool
+}
+
+func (s *recordingStream) finish(err error) error {
+	if s.recorded {
+		return nil
+	}
+	s.recorded = true
+	return s.client.record(s.interaction, err)
+}
+
+func (s *recordingStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err == nil {
+		s.interaction.Events = append(s.interaction.Events, event)
+		return event, nil
+	}
+	var recErr error
+	if err == io.EOF {
+		recErr = s.finish(nil)
+	} else {
+		recErr = s.finish(err)
+	}
+	if recErr != nil {
+		log.WithError(recErr).WithField("path", s.client.path).Error("Recording: failed to write the cassette")
+		return StreamEvent{}, fmt.Errorf("recording: %w", recErr)
+	}
+	return event, err
+}
+
+func (s *recordingStream) Close() error {
+	// A stream closed early is recorded as far as it was read.
+	if err := s.finish(nil); err != nil {
+		log.WithError(err).WithField("path", s.client.path).Error("Recording: failed to write the cassette")
+	}
+	return s.ChatCompletionStream.Close()
+}
+
+// Unwrap implements Wrapper.
+func (client *recordingClient) Unwrap() Client {
+	return client.client
+}
+
+// UnmatchedRequestError is returned by ReplayingClient when a request is not
+// in the cassette.
+type UnmatchedRequestError struct {
+	Path    string
+	Request ChatCompletionRequest
+	// Expected is the request expected next in strict order mode, if any.
+	Expected *ChatCompletionRequest
+}
+
+func (e *UnmatchedRequestError) Error() string {
+	req, _ := canonicalRequest(e.Request)
+	if e.Expected != nil {
+		expected, _ := canonicalRequest(*e.Expected)
+		return fmt.Sprintf("cassette %s: unexpected request %s, expected %s", e.Path, req, expected)
+	}
+	return fmt.Sprintf("cassette %s: no interaction matches request %s", e.Path, req)
+}
+
+// ReplayOption configures Replaying.
+type ReplayOption func(*ReplayingClient)
+
+// StrictOrder makes ReplayingClient require the requests to come in the
+// order in which they were recorded.
+func StrictOrder() ReplayOption {
+	return func(client *ReplayingClient) {
+		client.strict = true
+	}
+}
+
+type replayedInteraction struct {
+	Interaction
+	key  string
+	used bool
+}
+
+// ReplayingClient serves the interactions stored in a cassette by Recording.
+// Use Replaying to create one.
+type ReplayingClient struct {
+	path   string
+	strict bool
+
+	mu           sync.Mutex
+	interactions []*replayedInteraction
+	next         int
+}
+
+// Replaying returns a client that answers requests with the interactions in
+// the cassette at path, without talking to any provider. A request gets the
+// response of the first unused interaction with an identical request (the
+// Stream and Priority fields are not compared); every interaction is used
+// once. A request that can't be matched fails with an UnmatchedRequestError.
+func Replaying(path string, opts ...ReplayOption) (*ReplayingClient, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	client := &ReplayingClient{path: path}
+	for _, opt := range opts {
+		opt(client)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("cassette %s, line %d: %w", path, line, err)
+		}
+		key, err := canonicalRequest(interaction.Request)
+		if err != nil {
+			return nil, fmt.Errorf("cassette %s, line %d: %w", path, line, err)
+		}
+		client.interactions = append(client.interactions, &replayedInteraction{Interaction: interaction, key: key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Remaining returns the number of interactions that haven't been replayed
+// yet. Tests can check that it is zero, to make sure that everything that
+// was recorded was requested.
+func (client *ReplayingClient) Remaining() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	remaining := 0
+	for _, interaction := range client.interactions {
+		if !interaction.used {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+// match finds the interaction for req and marks it as used.
+func (client *ReplayingClient) match(req ChatCompletionRequest, stream bool) (Interaction, error) {
+	key, err := canonicalRequest(req)
+	if err != nil {
+		return Interaction{}, err
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.strict {
+		if client.next >= len(client.interactions) {
+			return Interaction{}, &UnmatchedRequestError{Path: client.path, Request: req}
+		}
+		interaction := client.interactions[client.next]
+		if interaction.key != key || interaction.Stream != stream {
+			return Interaction{}, &UnmatchedRequestError{Path: client.path, Request: req, Expected: &interaction.Request}
+		}
+		client.next++
+		interaction.used = true
+		return interaction.Interaction, nil
+	}
+	for _, interaction := range client.interactions {
+		if !interaction.used && interaction.key == key && interaction.Stream == stream {
+			interaction.used = true
+			return interaction.Interaction, nil
+		}
+	}
+	return Interaction{}, &UnmatchedRequestError{Path: client.path, Request: req}
+}
+
+// replayedError recreates a recorded error, keeping its class where it
+// matters for the callers.
+func replayedError(interaction Interaction) error {
+	if interaction.Error == "" {
+		return nil
+	}
+	err := errors.New(interaction.Error)
+	switch interaction.ErrorClass {
+	case "rate_limited":
+		return RateLimited(err)
+	case "retryable":
+		return Retryable(err)
+	}
+	return err
+}
+
+func (client *ReplayingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	interaction, err := client.match(req, false)
+	if err != nil {
+		log.WithError(err).Error("Replaying: unmatched request")
+		return ChatCompletionResponse{}, err
+	}
+	if req.Stream != nil && interaction.Streamed != "" {
+		if _, err := io.WriteString(req.Stream, interaction.Streamed); err != nil {
+			return ChatCompletionResponse{}, err
+		}
+	}
+	if err := replayedError(interaction); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	if interaction.Response == nil {
+		return ChatCompletionResponse{}, nil
+	}
+	return *interaction.Response, nil
+}
+
+// CreateChatCompletionStream implements StreamingClient. Only interactions
+// recorded with CreateChatCompletionStream are used.
+func (client *ReplayingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	interaction, err := client.match(req, true)
+	if err != nil {
+		log.WithError(err).Error("Replaying: unmatched request")
+		return nil, err
+	}
+	err = replayedError(interaction)
+	if err != nil && len(interaction.Events) == 0 {
+		return nil, err
+	}
+	return &replayedStream{events: interaction.Events, err: err}, nil
+}
+
+// replayedStream returns recorded events, and then the recorded error or
+// io.EOF.
+type replayedStream struct {
+	events []StreamEvent
+	err    error
+}
+
+func (s *replayedStream) Recv() (StreamEvent, error) {
+	if len(s.events) == 0 {
+		if s.err != nil {
+			return StreamEvent{}, s.err
+		}
+		return StreamEvent{}, io.EOF
+	}
+	event := s.events[0]
+	s.events = s.events[1:]
+	return event, nil
+}
+
+func (s *replayedStream) Close() error {
+	s.events = nil
+	return nil
+}
+
+var _ StreamingClient = (*ReplayingClient)(nil)
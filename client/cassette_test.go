@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamingAnswering is a StreamingClient that answers with content, word by
+// word when streaming.
+type streamingAnswering struct {
+	funcClient
+	content string
+}
+
+func (c streamingAnswering) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	var events []StreamEvent
+	for _, word := range strings.SplitAfter(c.content, " ") {
+		events = append(events, StreamEvent{Content: word})
+	}
+	events[len(events)-1].FinishReason = FinishReasonStop
+	return &sliceStream{events: events}, nil
+}
+
+func TestRecordingAndReplaying(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	inner := streamingAnswering{
+		funcClient: func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+			if req.Model == "broken" {
+				return ChatCompletionResponse{}, RateLimited(errors.New("too many requests"))
+			}
+			if req.Stream != nil {
+				req.Stream.Write([]byte("streamed"))
+			}
+			return ChatCompletionResponse{Choices: []Choice{{Message: Message{Role: Assistant, Content: "hello " + req.Model}}}}, nil
+		},
+		content: "one two three",
+	}
+
+	recording := Recording(inner, path)
+	_, err := recording.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "a"})
+	require.NoError(t, err)
+	var sb strings.Builder
+	_, err = recording.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "b", Stream: &sb})
+	require.NoError(t, err)
+	assert.Equal(t, "streamed", sb.String())
+	_, err = recording.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "broken"})
+	require.Error(t, err)
+	stream, err := recording.(StreamingClient).CreateChatCompletionStream(ctx, ChatCompletionRequest{Model: "c"})
+	require.NoError(t, err)
+	_, err = CollectStream(stream, nil)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 4)
+
+	replaying, err := Replaying(path)
+	require.NoError(t, err)
+
+	// Out of order is fine.
+	stream, err = replaying.CreateChatCompletionStream(ctx, ChatCompletionRequest{Model: "c"})
+	require.NoError(t, err)
+	var streamed strings.Builder
+	resp, err := CollectStream(stream, &streamed)
+	require.NoError(t, err)
+	assert.Equal(t, "one two three", streamed.String())
+	assert.Equal(t, FinishReasonStop, resp.Choices[0].FinishReason)
+
+	_, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "broken"})
+	assert.True(t, IsRateLimited(err))
+
+	resp, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "a"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello a", resp.Choices[0].Content)
+
+	sb.Reset()
+	resp, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "b", Stream: &sb})
+	require.NoError(t, err)
+	assert.Equal(t, "hello b", resp.Choices[0].Content)
+	assert.Equal(t, "streamed", sb.String())
+	assert.Equal(t, 0, replaying.Remaining())
+
+	// Every interaction is used once.
+	_, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "a"})
+	var unmatched *UnmatchedRequestError
+	assert.ErrorAs(t, err, &unmatched)
+}
+
+func TestReplayingStrictOrder(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	recording := Recording(answering("hi"), path)
+	for _, model := range []string{"a", "b"} {
+		_, err := recording.CreateChatCompletion(ctx, ChatCompletionRequest{Model: model})
+		require.NoError(t, err)
+	}
+
+	replaying, err := Replaying(path, StrictOrder())
+	require.NoError(t, err)
+	_, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "b"})
+	var unmatched *UnmatchedRequestError
+	require.ErrorAs(t, err, &unmatched)
+	assert.Equal(t, "a", unmatched.Expected.Model)
+
+	_, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "a"})
+	assert.NoError(t, err)
+	_, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "b"})
+	assert.NoError(t, err)
+	_, err = replaying.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "b"})
+	assert.ErrorAs(t, err, &unmatched)
+}
@@ -0,0 +1,240 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CircuitOpenError is returned by a circuit breaking client while its circuit
+// is open. It is not a RetryableError, so Retrying gives up immediately
+// instead of waiting for the circuit to close; Fallback will try the next
+// backend.
+type CircuitOpenError struct {
+	// Until is when the circuit will let probe requests through again.
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open until %s", e.Until.Format(time.RFC3339))
+}
+
+// CircuitPolicy configures CircuitBreaking. At least one of
+// ConsecutiveFailures and FailureRate has to be set.
+type CircuitPolicy struct {
+	// ConsecutiveFailures opens the circuit after this many failed requests
+	// in a row. Zero disables this condition.
+	ConsecutiveFailures int
+	// FailureRate opens the circuit when the fraction of failed requests
+	// among the last Window requests is at least FailureRate. Zero disables
+	// this condition.
+	FailureRate float64
+	// Window is the number of most recent requests considered by
+	// FailureRate. The rate is not checked until Window requests have
+	// completed.
+	Window int
+	// OpenFor is how long the circuit stays open before it becomes half-open
+	// and lets probe requests through.
+	OpenFor time.Duration
+	// HalfOpenProbes is the number of requests let through while half-open.
+	// If all of them succeed the circuit closes, if any fails it opens
+	// again. Defaults to 1.
+	HalfOpenProbes int
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+type circuitBreakingClient struct {
+	client Client
+	policy CircuitPolicy
+
+	mu          sync.Mutex
+	state       circuitState
+	openUntil   time.Time
+	consecutive int
+	// results is a ring buffer with the outcomes of the last policy.Window
+	// requests, true meaning failure.
+	results  []bool
+	next     int
+	recorded int
+	// probes is the number of probe requests let through while half-open,
+	// and probed the number of them that succeeded.
+	probes int
+	probed int
+}
+
+// CircuitBreaking wraps a Client and stops sending requests to it when it
+// seems to be down. Requests that fail with a retryable error, a network
+// error or a deadline count as failures; other errors (like an invalid
+// request) and cancellation by the caller do not. When the failures reach the
+// thresholds in policy, the circuit opens, and for policy.OpenFor all
+// requests fail immediately with a *CircuitOpenError. After that, the circuit
+// becomes half-open and lets through policy.HalfOpenProbes requests to decide
+// whether to close or open again.
+//
+// To protect the provider during outages, CircuitBreaking should wrap the
+// client that is passed to Retrying, so that every attempt is counted and
+// retries stop once the circuit opens.
+func CircuitBreaking(client Client, policy CircuitPolicy) Client {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	if policy.ConsecutiveFailures <= 0 && policy.FailureRate <= 0 {
+		panic("either ConsecutiveFailures or FailureRate must be set")
+	}
+	if policy.FailureRate > 0 && policy.Window <= 0 {
+		panic("Window must be positive when FailureRate is set")
+	}
+	if policy.HalfOpenProbes <= 0 {
+		policy.HalfOpenProbes = 1
+	}
+	return &circuitBreakingClient{
+		client:  client,
+		policy:  policy,
+		results: make([]bool, policy.Window),
+	}
+}
+
+// allow checks whether a request can be sent. probe is true if the request
+// is one of the half-open probes.
+func (client *circuitBreakingClient) allow() (probe bool, err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.state == circuitOpen {
+		if time.Now().Before(client.openUntil) {
+			return false, &CircuitOpenError{Until: client.openUntil}
+		}
+		client.transition(circuitHalfOpen)
+	}
+	if client.state == circuitHalfOpen {
+		if client.probes >= client.policy.HalfOpenProbes {
+			return false, &CircuitOpenError{Until: client.openUntil}
+		}
+		client.probes++
+		return true, nil
+	}
+	return false, nil
+}
+
+// record updates the circuit with the outcome of a request.
+func (client *circuitBreakingClient) record(ctx context.Context, probe bool, err error) {
+	failed := err != nil && ctx.Err() == nil && isBackendFailure(err)
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	switch client.state {
+	case circuitHalfOpen:
+		if !probe {
+			return
+		}
+		if failed {
+			client.open()
+			return
+		}
+		if err != nil {
+			// The probe was canceled or the request was invalid, which says
+			// nothing about the backend, so another probe is let through.
+			client.probes--
+			return
+		}
+		client.probed++
+		if client.probed >= client.policy.HalfOpenProbes {
+			client.transition(circuitClosed)
+		}
+	case circuitClosed:
+		if failed {
+			client.consecutive++
+		} else {
+			client.consecutive = 0
+		}
+		if len(client.results) > 0 {
+			client.results[client.next] = failed
+			client.next = (client.next + 1) % len(client.results)
+			if client.recorded < len(client.results) {
+				client.recorded++
+			}
+		}
+		if client.tripped() {
+			client.open()
+		}
+	}
+}
+
+// tripped returns true if the failures reached a threshold of the policy.
+func (client *circuitBreakingClient) tripped() bool {
+	if client.policy.ConsecutiveFailures > 0 && client.consecutive >= client.policy.ConsecutiveFailures {
+		return true
+	}
+	if client.policy.FailureRate > 0 && client.recorded == len(client.results) {
+		failures := 0
+		for _, failed := range client.results {
+			if failed {
+				failures++
+			}
+		}
+		return float64(failures)/float64(len(client.results)) >= client.policy.FailureRate
+	}
+	return false
+}
+
+func (client *circuitBreakingClient) open() {
+	client.openUntil = time.Now().Add(client.policy.OpenFor)
+	client.transition(circuitOpen)
+}
+
+// transition changes the state of the circuit and resets the counters.
+func (client *circuitBreakingClient) transition(state circuitState) {
+	log.WithField("from", client.state).WithField("to", state).Warn("Circuit state changed")
+	client.state = state
+	client.consecutive = 0
+	client.next = 0
+	client.recorded = 0
+	client.probes = 0
+	client.probed = 0
+}
+
+func (client *circuitBreakingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	probe, err := client.allow()
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	resp, err := client.client.CreateChatCompletion(ctx, req)
+	client.record(ctx, probe, err)
+	return resp, err
+}
+
+// CreateChatCompletionStream implements StreamingClient. Only errors creating
+// the stream are counted as failures.
+func (client *circuitBreakingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	probe, err := client.allow()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	client.record(ctx, probe, err)
+	return stream, err
+}
+
+// Unwrap implements Wrapper.
+func (client *circuitBreakingClient) Unwrap() Client {
+	return client.client
+}
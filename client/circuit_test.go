@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// switchClient fails with err while it is not nil, and counts the calls.
+type switchClient struct {
+	err   error
+	calls int
+}
+
+func (c *switchClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	c.calls++
+	if c.err != nil {
+		return ChatCompletionResponse{}, c.err
+	}
+	return answering("ok")(ctx, req)
+}
+
+func TestCircuitBreakingConsecutiveFailures(t *testing.T) {
+	ctx := context.Background()
+	backend := &switchClient{err: Retryable(errors.New("down"))}
+	cl := CircuitBreaking(backend, CircuitPolicy{ConsecutiveFailures: 3, OpenFor: 20 * time.Millisecond})
+
+	var rerr *RetryableError
+	for i := 0; i < 3; i++ {
+		_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+		assert.ErrorAs(t, err, &rerr)
+	}
+
+	// The circuit is open, so the backend is not called.
+	_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	var openErr *CircuitOpenError
+	assert.ErrorAs(t, err, &openErr)
+	assert.Equal(t, 3, backend.calls)
+
+	// After OpenFor a probe is let through, fails, and the circuit opens
+	// again.
+	time.Sleep(30 * time.Millisecond)
+	_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.ErrorAs(t, err, &rerr)
+	assert.Equal(t, 4, backend.calls)
+	_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.ErrorAs(t, err, &openErr)
+	assert.Equal(t, 4, backend.calls)
+
+	// The backend recovers, so the next probe closes the circuit.
+	backend.err = nil
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 7, backend.calls)
+}
+
+func TestCircuitBreakingFailureRate(t *testing.T) {
+	ctx := context.Background()
+	backend := &switchClient{}
+	cl := CircuitBreaking(backend, CircuitPolicy{FailureRate: 0.5, Window: 4, OpenFor: time.Hour})
+
+	// Two successes and one failure: below the rate.
+	cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	backend.err = Retryable(errors.New("down"))
+	cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	backend.err = nil
+	_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.NoError(t, err)
+
+	// Errors that are the fault of the request don't count.
+	backend.err = errors.New("invalid request")
+	for i := 0; i < 4; i++ {
+		_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+		assert.EqualError(t, err, "invalid request")
+	}
+
+	// Two more failures make it 2 out of the last 4.
+	backend.err = Retryable(errors.New("down"))
+	cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	_, err = cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	var openErr *CircuitOpenError
+	assert.ErrorAs(t, err, &openErr)
+}
+
+func TestCircuitBreakingCanceledProbe(t *testing.T) {
+	backend := &switchClient{err: Retryable(errors.New("down"))}
+	cl := CircuitBreaking(backend, CircuitPolicy{ConsecutiveFailures: 1, OpenFor: 20 * time.Millisecond}).(*circuitBreakingClient)
+	cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	time.Sleep(30 * time.Millisecond)
+
+	// A probe canceled by the caller says nothing about the backend, so it
+	// neither closes nor opens the circuit.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	backend.err = context.Canceled
+	_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, circuitHalfOpen, cl.state)
+
+	// The next probe is let through, and as the backend is still down the
+	// circuit opens again.
+	backend.err = Retryable(errors.New("down"))
+	_, err = cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	var rerr *RetryableError
+	assert.ErrorAs(t, err, &rerr)
+	_, err = cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	var openErr *CircuitOpenError
+	assert.ErrorAs(t, err, &openErr)
+	assert.Equal(t, 3, backend.calls)
+}
@@ -2,13 +2,18 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 )
 
 // RetryableError is an error from the API that can be retried.
 type RetryableError struct {
 	originalError error
+	rateLimited   bool
+	retryAfter    time.Duration
 }
 
 func (r RetryableError) Error() string {
@@ -19,45 +24,277 @@ func (r RetryableError) Unwrap() error {
 	return r.originalError
 }
 
+// RetryAfter returns how long the server asked to wait before retrying, or
+// zero if it didn't say.
+func (r RetryableError) RetryAfter() time.Duration {
+	return r.retryAfter
+}
+
 func Retryable(err error) error {
 	return &RetryableError{
 		originalError: err,
 	}
 }
 
+// RetryableAfter is like Retryable, but records that the server asked to
+// wait for the given duration before retrying.
+func RetryableAfter(err error, after time.Duration) error {
+	return &RetryableError{
+		originalError: err,
+		retryAfter:    after,
+	}
+}
+
+// RateLimited returns a RetryableError which indicates that the request was
+// refused because of rate limiting (like HTTP status 429).
+func RateLimited(err error) error {
+	return &RetryableError{
+		originalError: err,
+		rateLimited:   true,
+	}
+}
+
+// RateLimitedAfter is like RateLimited, but records that the server asked to
+// wait for the given duration before retrying.
+func RateLimitedAfter(err error, after time.Duration) error {
+	return &RetryableError{
+		originalError: err,
+		rateLimited:   true,
+		retryAfter:    after,
+	}
+}
+
+// IsRateLimited returns true if err is (or wraps) an error returned by
+// RateLimited.
+func IsRateLimited(err error) bool {
+	var rerr *RetryableError
+	return errors.As(err, &rerr) && rerr.rateLimited
+}
+
 type Role string
 
 const (
 	System    Role = "system"
 	User      Role = "user"
 	Assistant Role = "assistant"
+	// Tool is the role of messages that carry the result of a tool call back
+	// to the model. Such messages should have ToolCallID set.
+	Tool Role = "tool"
 )
 
 type ChatCompletionResponse struct {
-	Choices []Message `json:"choices"`
+	Choices []Choice `json:"choices"`
+	// Usage is the number of tokens used by the request. Not all providers
+	// report it; in that case it will be zero.
+	Usage Usage `json:"usage"`
+	// RateLimit is the state of the provider's rate limits after the
+	// request, if the provider reports it. It is not serialized, as it is
+	// only meaningful at the time of the response.
+	RateLimit *RateLimit `json:"-"`
+	// Metadata contains information added by clients and client wrappers,
+	// like the name of the backend that answered (see MetadataBackend).
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// MetadataBackend is the key of the response metadata that holds the name of
+// the backend that produced the response.
+const MetadataBackend = "backend"
+
+// MetadataCache is the key of the response metadata that CachedClient sets to
+// "hit" or "miss".
+const MetadataCache = "cache"
+
+// SetMetadata sets a metadata value of the response.
+func (r *ChatCompletionResponse) SetMetadata(key, value string) {
+	if r.Metadata == nil {
+		r.Metadata = make(map[string]string)
+	}
+	r.Metadata[key] = value
+}
+
+// Choice is one of the messages generated by the model, together with the
+// reason why the model stopped generating it.
+type Choice struct {
+	Message
+	FinishReason FinishReason `json:"finish_reason,omitempty"`
+}
+
+// FinishReason is the reason why the model stopped generating a message.
+type FinishReason string
+
+const (
+	// FinishReasonStop means that the model reached a natural stopping
+	// point or a stop sequence.
+	FinishReasonStop FinishReason = "stop"
+	// FinishReasonLength means that the message was truncated because it
+	// reached MaxTokens.
+	FinishReasonLength FinishReason = "length"
+	// FinishReasonToolCalls means that the model wants to call tools.
+	FinishReasonToolCalls FinishReason = "tool_calls"
+	// FinishReasonContentFilter means that content was omitted by the
+	// provider's content filter.
+	FinishReasonContentFilter FinishReason = "content_filter"
+)
+
+// Usage contains the token counts for a request.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type Message struct {
 	Content string `json:"content"`
 	Role    Role   `json:"role"`
+
+	// Parts are additional content parts of the message, like images. If
+	// Content is not empty, it's treated as a text part preceding Parts.
+	// Clients that don't support some kind of parts return an error.
+	Parts []ContentPart `json:"parts,omitempty"`
+
+	// ToolCalls are the tools the model wants to call. Only set on messages
+	// from the Assistant.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the ID of the ToolCall this message is the result of. Only
+	// set on messages with the Tool role.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// Text returns the text content of the message: Content followed by the text
+// parts, separated by newlines.
+func (m Message) Text() string {
+	texts := make([]string, 0, len(m.Parts)+1)
+	if m.Content != "" {
+		texts = append(texts, m.Content)
+	}
+	for _, part := range m.Parts {
+		if part.Type == ContentPartText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// HasImages returns true if any of the message's parts is an image.
+func (m Message) HasImages() bool {
+	for _, part := range m.Parts {
+		if part.Type == ContentPartImageURL || part.Type == ContentPartImageData {
+			return true
+		}
+	}
+	return false
+}
+
+type ContentPartType string
+
+const (
+	ContentPartText      ContentPartType = "text"
+	ContentPartImageURL  ContentPartType = "image_url"
+	ContentPartImageData ContentPartType = "image_data"
+)
+
+// ContentPart is a part of a message's content. Use TextPart, ImageURLPart
+// and ImageDataPart to create one.
+type ContentPart struct {
+	Type ContentPartType `json:"type"`
+	Text string          `json:"text,omitempty"`
+	// URL of the image, for ContentPartImageURL.
+	URL string `json:"url,omitempty"`
+	// Data and MIMEType hold an inline image, for ContentPartImageData. Data
+	// is the raw image, it will be base64 encoded by the clients if needed.
+	Data     []byte `json:"data,omitempty"`
+	MIMEType string `json:"mime_type,omitempty"`
+}
+
+// TextPart returns a text ContentPart.
+func TextPart(text string) ContentPart {
+	return ContentPart{Type: ContentPartText, Text: text}
 }
 
-// FIXME(ryszard): What about N?
+// ImageURLPart returns a ContentPart with an image available at url.
+func ImageURLPart(url string) ContentPart {
+	return ContentPart{Type: ContentPartImageURL, URL: url}
+}
+
+// ImageDataPart returns a ContentPart with an inline image, like
+// ImageDataPart("image/png", data).
+func ImageDataPart(mimeType string, data []byte) ContentPart {
+	return ContentPart{Type: ContentPartImageData, MIMEType: mimeType, Data: data}
+}
+
+// ToolDefinition describes a tool that the model may decide to call.
+type ToolDefinition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Parameters is a JSON Schema object describing the arguments of the
+	// tool. It has to be marshalable to JSON.
+	Parameters any `json:"parameters,omitempty"`
+}
+
+// ToolCall is a request from the model to call a tool.
+type ToolCall struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Arguments are the JSON encoded arguments for the tool, as generated by
+	// the model. Note that the model may produce invalid JSON, or arguments
+	// that don't match the schema.
+	Arguments string `json:"arguments"`
+}
+
+// ToolChoice controls which (if any) tool is called by the model. Apart from
+// the predefined values, it can be the name of a tool, which forces the model
+// to call that tool. The empty value leaves the decision to the provider's
+// default.
+type ToolChoice string
+
+const (
+	ToolChoiceAuto ToolChoice = "auto"
+	ToolChoiceNone ToolChoice = "none"
+)
 
 type ChatCompletionRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	MaxTokens   int       `json:"max_tokens"`
-	Temperature float32   `json:"temperature"`
+	Model     string    `json:"model"`
+	Messages  []Message `json:"messages"`
+	MaxTokens int       `json:"max_tokens"`
+	// Temperature is nil to use the provider's default, which is usually
+	// not 0.
+	Temperature *float32 `json:"temperature,omitempty"`
+
+	// The following sampling parameters are optional: nil or the zero value
+	// means the provider's default. Clients return an error if a parameter
+	// is set but not supported by the provider.
+	TopP             *float32 `json:"top_p,omitempty"`
+	TopK             *int     `json:"top_k,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	Seed             *int     `json:"seed,omitempty"`
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	// N is the number of choices to generate.
+	N int `json:"n,omitempty"`
+	// User is an identifier of the end user, which some providers use to
+	// detect abuse.
+	User string `json:"user,omitempty"`
+
 	// This is an escape hatch for passing arbitrary parameters to the APIs. It
 	// is the client's responsibility to ensure that the parameters are valid
-	// for the model.
+	// for the model. CustomParams are applied after the typed fields, so they
+	// take precedence.
 	CustomParams map[string]interface{} `json:"params"`
 
+	// Tools are the tools the model may call. Not all clients support tools.
+	Tools      []ToolDefinition `json:"tools,omitempty"`
+	ToolChoice ToolChoice       `json:"tool_choice,omitempty"`
+
 	// If Stream is not nil, the client will use the streaming API. The client
 	// should write the message content from the server as it appears on the
 	// wire to Stream, and then still return the whole message.
 	Stream io.Writer `json:"-"` // This should not be used when hashing.
+
+	// Priority orders the request in client wrappers that queue requests
+	// (see Queued): higher values go first. If it is zero, the priority
+	// stored in the context by WithPriority is used. It is not sent to the
+	// provider.
+	Priority int `json:"-"`
 }
 
 func (r ChatCompletionRequest) WantsStreaming() bool {
@@ -66,10 +303,8 @@ func (r ChatCompletionRequest) WantsStreaming() bool {
 
 // Client is an interface for the LLM API client. Any methods that return errors
 // should return a RetryableError (by calling Retryable) if the error is
-// retryable, or any other error if it is not.
+// retryable, or any other error if it is not. Clients should also implement
+// Capabilities.
 type Client interface {
 	CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error)
-
-	// TODO(ryszard): Implement this.
-	//SupportedParameters() []string
 }
@@ -0,0 +1,37 @@
+package client
+
+import "context"
+
+type agentNameKey struct{}
+
+// WithAgentName returns a copy of ctx carrying the name of the agent making
+// the request. agent.BaseAgent does this automatically in Respond, so that
+// client wrappers (like Budgeted) can attribute requests to agents.
+func WithAgentName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, agentNameKey{}, name)
+}
+
+// AgentName returns the name of the agent stored in ctx by WithAgentName, or
+// the empty string if there is none.
+func AgentName(ctx context.Context) string {
+	name, _ := ctx.Value(agentNameKey{}).(string)
+	return name
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx carrying the priority of the requests
+// made with it. See ChatCompletionRequest.Priority.
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// Priority returns the priority of req: req.Priority if it is set, or else
+// the one stored in ctx by WithPriority, or zero.
+func Priority(ctx context.Context, req ChatCompletionRequest) int {
+	if req.Priority != 0 {
+		return req.Priority
+	}
+	priority, _ := ctx.Value(priorityKey{}).(int)
+	return priority
+}
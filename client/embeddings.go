@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EmbeddingClient is an interface for clients of APIs that compute embeddings.
+// Like Client, it should return a RetryableError if an error is retryable.
+type EmbeddingClient interface {
+	// CreateEmbeddings returns an embedding for each of the inputs, in the
+	// same order.
+	CreateEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error)
+}
+
+type retryingEmbeddingClient struct {
+	client EmbeddingClient
+	retryPolicy
+}
+
+// RetryingEmbeddings is like Retrying, but for an EmbeddingClient.
+func RetryingEmbeddings(client EmbeddingClient, baseWait time.Duration, maxWait time.Duration, maxRetries int, opts ...RetryOption) EmbeddingClient {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	return &retryingEmbeddingClient{
+		client:      client,
+		retryPolicy: newRetryPolicy(baseWait, maxWait, maxRetries, opts...),
+	}
+}
+
+func (client *retryingEmbeddingClient) CreateEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	embeddings, err := retry(ctx, client.retryPolicy, func(ctx context.Context) (any, error) {
+		return client.client.CreateEmbeddings(ctx, model, inputs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return embeddings.([][]float32), nil
+}
+
+type rateLimitingEmbeddingClient struct {
+	client  EmbeddingClient
+	limiter Limiter
+}
+
+// RateLimitingEmbeddings is like RateLimiting, but for an EmbeddingClient.
+// Each call to CreateEmbeddings counts as one request, regardless of the
+// number of inputs.
+func RateLimitingEmbeddings(client EmbeddingClient, limiter Limiter) EmbeddingClient {
+	return &rateLimitingEmbeddingClient{
+		client:  client,
+		limiter: limiter,
+	}
+}
+
+func (client *rateLimitingEmbeddingClient) CreateEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	if err := client.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return client.client.CreateEmbeddings(ctx, model, inputs)
+}
+
+// CachedEmbeddingClient is an EmbeddingClient that caches embeddings.
+type CachedEmbeddingClient struct {
+	client EmbeddingClient
+	cache  Cache
+}
+
+// CachedEmbeddings wraps an EmbeddingClient with a cache. Embeddings are
+// cached for each input separately, so only the inputs that are not in the
+// cache are sent to the wrapped client.
+func CachedEmbeddings(client EmbeddingClient, cache Cache) *CachedEmbeddingClient {
+	return &CachedEmbeddingClient{
+		client: client,
+		cache:  cache,
+	}
+}
+
+var _ EmbeddingClient = (*CachedEmbeddingClient)(nil)
+
+// CreateEmbeddings implements EmbeddingClient.
+func (c *CachedEmbeddingClient) CreateEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	embeddings := make([][]float32, len(inputs))
+	keys := make([][]byte, len(inputs))
+
+	// Indexes and values of inputs that weren't in the cache.
+	var missing []int
+	var missingInputs []string
+	for i, input := range inputs {
+		key, err := hash(struct {
+			Model string `json:"model"`
+			Input string `json:"input"`
+		}{model, input})
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+
+		val, ok, err := c.cache.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, i)
+			missingInputs = append(missingInputs, input)
+			continue
+		}
+		if err := json.Unmarshal(val, &embeddings[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	log.WithField("hits", len(inputs)-len(missing)).WithField("misses", len(missing)).Debug("embeddings cache")
+	if len(missing) == 0 {
+		return embeddings, nil
+	}
+
+	fetched, err := c.client.CreateEmbeddings(ctx, model, missingInputs)
+	if err != nil {
+		return nil, err
+	}
+	if len(fetched) != len(missing) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(missing), len(fetched))
+	}
+
+	for j, i := range missing {
+		embeddings[i] = fetched[j]
+		val, err := json.Marshal(fetched[j])
+		if err != nil {
+			return nil, err
+		}
+		if err := c.cache.Set(keys[i], val); err != nil {
+			return nil, err
+		}
+	}
+
+	return embeddings, nil
+}
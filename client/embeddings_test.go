@@ -0,0 +1,43 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ryszard/agency/util/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockEmbeddingClient struct {
+	requested [][]string
+}
+
+func (m *mockEmbeddingClient) CreateEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	m.requested = append(m.requested, inputs)
+	embeddings := make([][]float32, len(inputs))
+	for i, input := range inputs {
+		embeddings[i] = []float32{float32(len(input))}
+	}
+	return embeddings, nil
+}
+
+func TestCachedEmbeddingClient(t *testing.T) {
+	backend := &mockEmbeddingClient{}
+	cl := CachedEmbeddings(backend, cache.Memory())
+	ctx := context.Background()
+
+	embeddings, err := cl.CreateEmbeddings(ctx, "model", []string{"a", "bb"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{1}, {2}}, embeddings)
+
+	// Only the input that is not cached should be sent to the backend.
+	embeddings, err = cl.CreateEmbeddings(ctx, "model", []string{"bb", "ccc", "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{2}, {3}, {1}}, embeddings)
+	assert.Equal(t, [][]string{{"a", "bb"}, {"ccc"}}, backend.requested)
+
+	// Embeddings are cached per model.
+	_, err = cl.CreateEmbeddings(ctx, "other-model", []string{"a"})
+	assert.NoError(t, err)
+	assert.Len(t, backend.requested, 3)
+}
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"reflect"
+	"strings"
 
 	"github.com/madebywelch/anthropic-go/pkg/anthropic"
 	"github.com/ryszard/agency/client"
@@ -51,6 +54,21 @@ const (
 	ClaudeInstantV1_0 = "claude-instant-v1.0"
 )
 
+// Prices are the prices of the models, for use with client.Budgeted.
+var Prices = map[string]client.Price{
+	ClaudeV1:               {Prompt: 0.01102, Completion: 0.03268},
+	ClaudeV1_100k:          {Prompt: 0.01102, Completion: 0.03268},
+	ClaudeV1_3:             {Prompt: 0.01102, Completion: 0.03268},
+	ClaudeV1_3_100k:        {Prompt: 0.01102, Completion: 0.03268},
+	ClaudeV1_2:             {Prompt: 0.01102, Completion: 0.03268},
+	ClaudeV1_0:             {Prompt: 0.01102, Completion: 0.03268},
+	ClaudeInstantV1:        {Prompt: 0.00163, Completion: 0.00551},
+	ClaudeInstantV1_100k:   {Prompt: 0.00163, Completion: 0.00551},
+	ClaudeInstantV1_1:      {Prompt: 0.00163, Completion: 0.00551},
+	ClaudeInstantV1_1_100k: {Prompt: 0.00163, Completion: 0.00551},
+	ClaudeInstantV1_0:      {Prompt: 0.00163, Completion: 0.00551},
+}
+
 type Client struct {
 	client *anthropic.Client
 }
@@ -65,67 +83,209 @@ func New(apiKey string) (*Client, error) {
 	}, nil
 }
 
+var _ client.StreamingClient = (*Client)(nil)
+
+// customParams are the CustomParams understood by TranslateRequest.
+var customParams = map[string]reflect.Type{
+	"stop_sequences": reflect.TypeOf([]string{}),
+	"top_k":          reflect.TypeOf(0),
+	"top_p":          reflect.TypeOf(float64(0)),
+}
+
+func (Client) SupportsStreaming() bool {
+	return true
+}
+
+// SupportsTools returns false, as the completion API has no tool calling.
+func (Client) SupportsTools() bool {
+	return false
+}
+
+// SupportsImages returns false, as the completion API only accepts text.
+func (Client) SupportsImages() bool {
+	return false
+}
+
+func (Client) SupportedParameters() map[string]reflect.Type {
+	return customParams
+}
+
+func (Client) MaxContextTokens(model string) (int, bool) {
+	if _, ok := Prices[model]; !ok {
+		return 0, false
+	}
+	if strings.HasSuffix(model, "-100k") {
+		return 100000, true
+	}
+	return 9000, true
+}
+
+var _ client.Capabilities = (*Client)(nil)
+
 func (cl *Client) CreateChatCompletion(ctx context.Context, req client.ChatCompletionRequest) (client.ChatCompletionResponse, error) {
 	request, err := TranslateRequest(&req)
 	if err != nil {
 		return client.ChatCompletionResponse{}, err
 	}
 	if req.WantsStreaming() {
-		return cl.createChatCompletionStream(ctx, req, req.Stream)
+		stream, err := cl.CreateChatCompletionStream(ctx, req)
+		if err != nil {
+			return client.ChatCompletionResponse{}, err
+		}
+		resp, err := client.CollectStream(stream, req.Stream)
+		if err != nil {
+			return client.ChatCompletionResponse{}, err
+		}
+		req.Stream.Write([]byte("\n"))
+		return resp, nil
 	}
 	resp, err := cl.client.Complete(request, nil)
 	if err != nil {
-		return client.ChatCompletionResponse{}, err
+		return client.ChatCompletionResponse{}, maybeWrapError(err)
 	}
 	return TranslateResponse(resp), nil
 }
 
+// maybeWrapError wraps errors that can be retried. The anthropic package
+// doesn't expose the response headers, so unlike the other clients the errors
+// can't say how long to wait, and Retrying falls back to its backoff. For the
+// same reason, responses don't report client.RateLimit.
 func maybeWrapError(err error) error {
-	if errors.Is(err, anthropic.ErrAnthropicRateLimit) || errors.Is(err, anthropic.ErrAnthropicInternalServer) {
+	if errors.Is(err, anthropic.ErrAnthropicRateLimit) {
+		return client.RateLimited(err)
+	}
+	if errors.Is(err, anthropic.ErrAnthropicInternalServer) {
 		return client.Retryable(err)
 	}
 	return err
 }
 
-func (cl *Client) createChatCompletionStream(ctx context.Context, req client.ChatCompletionRequest, w io.Writer) (client.ChatCompletionResponse, error) {
-
+// CreateChatCompletionStream implements client.StreamingClient.
+func (cl *Client) CreateChatCompletionStream(ctx context.Context, req client.ChatCompletionRequest) (client.ChatCompletionStream, error) {
 	request, err := TranslateRequest(&req)
 	if err != nil {
-		return client.ChatCompletionResponse{}, err
+		return nil, err
 	}
-
 	request.Stream = true
-	var response *anthropic.CompletionResponse
 
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &chatCompletionStream{
+		events: make(chan client.StreamEvent),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	// The callback receives the completion accumulated so far, so we need to
+	// keep track of what we have already sent.
+	sent := 0
 	callback := func(resp *anthropic.CompletionResponse) error {
 		log.WithField("resp", fmt.Sprintf("%#v", resp)).Debug("Received response from server")
-		response = resp
-		if _, err := w.Write([]byte(resp.Delta)); err != nil {
-			return err
+		event := client.StreamEvent{
+			Content:      resp.Completion[sent:],
+			FinishReason: TranslateStopReason(resp.StopReason),
+		}
+		sent = len(resp.Completion)
+		select {
+		case stream.events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		return nil
 	}
 
-	_, err = cl.client.Complete(request, callback)
-	if err != nil {
-		return client.ChatCompletionResponse{}, maybeWrapError(err)
+	go func() {
+		defer close(stream.done)
+		if _, err := cl.client.Complete(request, callback); err != nil {
+			stream.err = maybeWrapError(err)
+		}
+	}()
+
+	return stream, nil
+}
+
+// chatCompletionStream adapts the callback based streaming of the anthropic
+// package to client.ChatCompletionStream.
+type chatCompletionStream struct {
+	events chan client.StreamEvent
+	// done is closed once the request finishes, after setting err.
+	done   chan struct{}
+	err    error
+	cancel context.CancelFunc
+}
+
+func (s *chatCompletionStream) Recv() (client.StreamEvent, error) {
+	select {
+	case event := <-s.events:
+		return event, nil
+	case <-s.done:
+		if s.err != nil {
+			return client.StreamEvent{}, s.err
+		}
+		return client.StreamEvent{}, io.EOF
 	}
-	w.Write([]byte("\n"))
-	return TranslateResponse(response), nil
 }
 
+func (s *chatCompletionStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// TranslateResponse translates a CompletionResponse from the anthropic package
+// to a ChatCompletionResponse. Note that the completion API doesn't report
+// token usage, so Usage will be zero.
 func TranslateResponse(resp *anthropic.CompletionResponse) client.ChatCompletionResponse {
 	return client.ChatCompletionResponse{
-		Choices: []client.Message{{Role: client.Assistant, Content: resp.Completion}},
+		Choices: []client.Choice{{
+			Message:      client.Message{Role: client.Assistant, Content: resp.Completion},
+			FinishReason: TranslateStopReason(resp.StopReason),
+		}},
+	}
+}
+
+// TranslateStopReason translates the stop reason returned by the completion
+// API to a client.FinishReason.
+func TranslateStopReason(reason string) client.FinishReason {
+	switch reason {
+	case "stop_sequence":
+		return client.FinishReasonStop
+	case "max_tokens":
+		return client.FinishReasonLength
+	default:
+		return ""
 	}
 }
 
 func TranslateRequest(clientReq *client.ChatCompletionRequest) (*anthropic.CompletionRequest, error) {
+	if len(clientReq.Tools) > 0 || clientReq.ToolChoice != "" {
+		return nil, fmt.Errorf("tools are not supported by the anthropic completion API")
+	}
+	for _, m := range clientReq.Messages {
+		if m.HasImages() {
+			return nil, fmt.Errorf("images are not supported by the anthropic completion API")
+		}
+	}
+	if clientReq.Seed != nil || clientReq.PresencePenalty != nil || clientReq.FrequencyPenalty != nil || clientReq.N > 1 || clientReq.User != "" {
+		return nil, fmt.Errorf("seed, presence_penalty, frequency_penalty, n and user are not supported by the anthropic completion API")
+	}
 	req := anthropic.CompletionRequest{
 		Model:             anthropic.Model(clientReq.Model),
 		MaxTokensToSample: clientReq.MaxTokens,
-		Temperature:       float64(clientReq.Temperature),
 		Prompt:            TranslateMessages(clientReq.Messages),
+		StopSequences:     clientReq.Stop,
+	}
+	if clientReq.Temperature != nil {
+		req.Temperature = float64(*clientReq.Temperature)
+		if req.Temperature == 0 {
+			// anthropic-go omits a temperature of 0, which would make it the
+			// default, so the smallest one above 0 is sent instead.
+			req.Temperature = math.SmallestNonzeroFloat64
+		}
+	}
+	if clientReq.TopK != nil {
+		req.TopK = *clientReq.TopK
+	}
+	if clientReq.TopP != nil {
+		req.TopP = float64(*clientReq.TopP)
 	}
 
 	if stopSequences, ok := clientReq.CustomParams["stop_sequences"]; ok {
@@ -157,12 +317,12 @@ func TranslateRequest(clientReq *client.ChatCompletionRequest) (*anthropic.Compl
 func TranslateMessages(messages []client.Message) string {
 	var s string
 	for _, m := range messages {
-		if m.Role == client.User || m.Role == client.System {
+		if m.Role == client.User || m.Role == client.System || m.Role == client.Tool {
 			s += "Human: "
 		} else {
 			s += "Assistant: "
 		}
-		s += m.Content + "\n\n"
+		s += m.Text() + "\n\n"
 	}
 	if len(messages) > 0 {
 		s += "Assistant:"
@@ -9,6 +9,10 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func intPtr(i int) *int { return &i }
+
+func float32Ptr(f float32) *float32 { return &f }
+
 func TestTranslateRequest(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -21,7 +25,7 @@ func TestTranslateRequest(t *testing.T) {
 			input: client.ChatCompletionRequest{
 				Model:       "claude-v1",
 				MaxTokens:   100,
-				Temperature: 0.5,
+				Temperature: float32Ptr(0.5),
 				CustomParams: map[string]interface{}{
 					"stop_sequences": []string{"stop1", "stop2"},
 					"top_k":          10,
@@ -38,6 +42,24 @@ func TestTranslateRequest(t *testing.T) {
 				TopP:              0.9,
 			},
 		},
+		{
+			name: "Typed sampling parameters",
+			input: client.ChatCompletionRequest{
+				Model:     "claude-v1",
+				MaxTokens: 100,
+				Stop:      []string{"stop1"},
+				TopK:      intPtr(5),
+				TopP:      float32Ptr(0.5),
+			},
+			err: nil,
+			expected: anthropic.CompletionRequest{
+				Model:             "claude-v1",
+				MaxTokensToSample: 100,
+				StopSequences:     []string{"stop1"},
+				TopK:              5,
+				TopP:              0.5,
+			},
+		},
 		{
 			name: "Messages",
 			input: client.ChatCompletionRequest{
@@ -73,6 +95,22 @@ Assistant:`,
 	}
 }
 
+func TestTranslateRequestRejectsUnsupportedParams(t *testing.T) {
+	_, err := TranslateRequest(&client.ChatCompletionRequest{
+		Model: "claude-v1",
+		Seed:  intPtr(1),
+	})
+	assert.Error(t, err)
+}
+
+func TestTranslateRequestRejectsTools(t *testing.T) {
+	_, err := TranslateRequest(&client.ChatCompletionRequest{
+		Model: "claude-v1",
+		Tools: []client.ToolDefinition{{Name: "bash"}},
+	})
+	assert.Error(t, err)
+}
+
 func TestTranslateMessages(t *testing.T) {
 
 	for _, tc := range []struct {
@@ -93,6 +131,20 @@ Assistant: 2
 
 Human: 3
 
+Assistant:`},
+		{
+			name: "Tool results",
+			input: []client.Message{
+				{Role: client.User, Content: "1"},
+				{Role: client.Assistant, Content: "2"},
+				{Role: client.Tool, Content: "3"},
+			},
+			expected: `Human: 1
+
+Assistant: 2
+
+Human: 3
+
 Assistant:`},
 		{
 			name: "Basic Translation",
@@ -130,10 +182,31 @@ func TestTranslateResponse(t *testing.T) {
 				Stop:       "Test stop 1",
 			},
 			expected: client.ChatCompletionResponse{
-				Choices: []client.Message{
+				Choices: []client.Choice{
+					{
+						Message: client.Message{
+							Content: "Test completion 1",
+							Role:    client.Assistant,
+						},
+						FinishReason: client.FinishReasonStop,
+					},
+				},
+			},
+		},
+		{
+			name: "Test 2: Truncated",
+			input: &anthropic.CompletionResponse{
+				Completion: "Test completion 2",
+				StopReason: "max_tokens",
+			},
+			expected: client.ChatCompletionResponse{
+				Choices: []client.Choice{
 					{
-						Content: "Test completion 1",
-						Role:    client.Assistant,
+						Message: client.Message{
+							Content: "Test completion 2",
+							Role:    client.Assistant,
+						},
+						FinishReason: client.FinishReasonLength,
 					},
 				},
 			},
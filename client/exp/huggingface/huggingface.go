@@ -8,29 +8,62 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/ryszard/agency/client"
 	log "github.com/sirupsen/logrus"
 )
 
-// FIXME(ryszard): Implement retryable errors.
-
 type Client struct {
-	token   string
-	http    *http.Client
-	baseURL string
+	token       string
+	http        *http.Client
+	baseURL     string
+	pipelineURL string
 }
 
 func (Client) SupportsStreaming() bool {
 	return false
 }
 
+func (Client) SupportsTools() bool {
+	return false
+}
+
+func (Client) SupportsImages() bool {
+	return false
+}
+
+// customParams are the CustomParams understood by TranslateRequest.
+var customParams = map[string]reflect.Type{
+	"use_cache":          reflect.TypeOf(false),
+	"wait_for_model":     reflect.TypeOf(false),
+	"min_length":         reflect.TypeOf(0),
+	"top_k":              reflect.TypeOf(0),
+	"top_p":              reflect.TypeOf(float64(0)),
+	"repetition_penalty": reflect.TypeOf(float64(0)),
+	"max_time":           reflect.TypeOf(float64(0)),
+}
+
+func (Client) SupportedParameters() map[string]reflect.Type {
+	return customParams
+}
+
+// MaxContextTokens always returns false, as the context size depends on the
+// model, and the API doesn't expose it.
+func (Client) MaxContextTokens(model string) (int, bool) {
+	return 0, false
+}
+
+var _ client.Capabilities = (*Client)(nil)
+
 func New(token string) *Client {
 	return &Client{
-		token:   token,
-		http:    &http.Client{},
-		baseURL: "https://api-inference.huggingface.co/models/",
+		token:       token,
+		http:        &http.Client{},
+		baseURL:     "https://api-inference.huggingface.co/models/",
+		pipelineURL: "https://api-inference.huggingface.co/pipeline/",
 	}
 }
 
@@ -81,10 +114,48 @@ func (cl *Client) CreateChatCompletion(ctx context.Context, request client.ChatC
 		return client.ChatCompletionResponse{}, err
 	}
 	log.WithField("resp", resp).Debug("huggingface response")
-	request.Stream.Write([]byte(resp.GeneratedText + "\n"))
+	if request.WantsStreaming() {
+		request.Stream.Write([]byte(resp.GeneratedText + "\n"))
+	}
 	return TranslateResponse(resp)
 }
 
+type FeatureExtractionRequest struct {
+	Inputs  []string `json:"inputs"`
+	Options Options  `json:"options,omitempty"`
+}
+
+var _ client.EmbeddingClient = (*Client)(nil)
+
+// CreateEmbeddings implements client.EmbeddingClient, using the
+// feature-extraction pipeline. The model has to return one embedding per
+// input (like sentence-transformers models do), and not one per token.
+func (cl *Client) CreateEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	payload := FeatureExtractionRequest{
+		Inputs:  inputs,
+		Options: Options{WaitForModel: true},
+	}
+	var resp json.RawMessage
+	if err := cl.MakeRequest(ctx, cl.pipelineURL+"feature-extraction/"+model, payload, &resp); err != nil {
+		return nil, err
+	}
+	return TranslateFeatureExtractionResponse(resp)
+}
+
+// TranslateFeatureExtractionResponse parses the response of the
+// feature-extraction pipeline.
+func TranslateFeatureExtractionResponse(resp json.RawMessage) ([][]float32, error) {
+	var embeddings [][]float32
+	if err := json.Unmarshal(resp, &embeddings); err != nil {
+		var errResp ConversationalResponse
+		if json.Unmarshal(resp, &errResp) == nil && errResp.Error != "" {
+			return nil, errors.New(errResp.Error)
+		}
+		return nil, fmt.Errorf("unexpected feature-extraction response (is this a sentence embedding model?): %w", err)
+	}
+	return embeddings, nil
+}
+
 func (cl *Client) MakeRequest(ctx context.Context, urlStr string, payload any, out any) error {
 	// The Hugging Face API expects to receive a JSON string containing the JSON
 	// encoded body. Weird, but what can you do.
@@ -117,12 +188,46 @@ func (cl *Client) MakeRequest(ctx context.Context, urlStr string, payload any, o
 		return err
 	}
 	log.WithField("respBody", string(respBody)).Debug("huggingface response body")
+	if resp.StatusCode != http.StatusOK {
+		return TranslateError(resp, respBody)
+	}
 	if err := json.Unmarshal(respBody, &out); err != nil {
 		return err
 	}
 	return nil
 }
 
+// ErrorResponse is the body of an error response.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// EstimatedTime is how many seconds it will take to load the model, if
+	// the error is because it is not loaded yet.
+	EstimatedTime float64 `json:"estimated_time,omitempty"`
+}
+
+// TranslateError returns the error for an unsuccessful response with the
+// given body. Errors because the model is loading, because of rate limits or
+// because of a server error are retryable, and the time the model needs to
+// load is used as the time to wait before retrying.
+func TranslateError(resp *http.Response, body []byte) error {
+	var errResp ErrorResponse
+	var err error
+	if json.Unmarshal(body, &errResp) == nil && errResp.Error != "" {
+		err = errors.New(errResp.Error)
+	} else {
+		err = fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	switch {
+	case resp.StatusCode == http.StatusServiceUnavailable && errResp.EstimatedTime > 0:
+		return client.RetryableAfter(err, time.Duration(errResp.EstimatedTime*float64(time.Second)))
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return client.RateLimitedAfter(err, client.ParseRetryAfter(resp.Header))
+	case resp.StatusCode >= 500:
+		return client.RetryableAfter(err, client.ParseRetryAfter(resp.Header))
+	}
+	return err
+}
+
 func TranslateResponse(cr ConversationalResponse) (client.ChatCompletionResponse, error) {
 	if cr.Error != "" {
 		return client.ChatCompletionResponse{}, errors.New(cr.Error)
@@ -132,8 +237,10 @@ func TranslateResponse(cr ConversationalResponse) (client.ChatCompletionResponse
 		Role:    client.Assistant,
 	}
 
+	// The conversational pipeline reports neither token usage nor why the
+	// generation stopped.
 	ccr := client.ChatCompletionResponse{
-		Choices: []client.Message{msg},
+		Choices: []client.Choice{{Message: msg}},
 	}
 
 	return ccr, nil
@@ -195,13 +302,32 @@ func TranslateRequest(clientReq client.ChatCompletionRequest) (ConversationalReq
 			return ConversationalRequest{}, fmt.Errorf("custom param %q is reserved", param)
 		}
 	}
+	if len(clientReq.Tools) > 0 || clientReq.ToolChoice != "" {
+		return ConversationalRequest{}, fmt.Errorf("tools are not supported by the huggingface client")
+	}
+	for _, msg := range clientReq.Messages {
+		if len(msg.Parts) > 0 {
+			return ConversationalRequest{}, fmt.Errorf("content parts are not supported by the huggingface client")
+		}
+	}
+	if len(clientReq.Stop) > 0 || clientReq.Seed != nil || clientReq.PresencePenalty != nil || clientReq.FrequencyPenalty != nil || clientReq.N > 1 || clientReq.User != "" {
+		return ConversationalRequest{}, fmt.Errorf("stop, seed, presence_penalty, frequency_penalty, n and user are not supported by the huggingface client")
+	}
 	req := ConversationalRequest{
 		Model: clientReq.Model,
 		Parameters: Parameters{
-			MaxLength:   clientReq.MaxTokens,
-			Temperature: float64(clientReq.Temperature),
+			MaxLength: clientReq.MaxTokens,
 		},
 	}
+	if clientReq.Temperature != nil {
+		req.Parameters.Temperature = float64(*clientReq.Temperature)
+	}
+	if clientReq.TopK != nil {
+		req.Parameters.TopK = *clientReq.TopK
+	}
+	if clientReq.TopP != nil {
+		req.Parameters.TopP = float64(*clientReq.TopP)
+	}
 
 	if err := TranslateMessages(clientReq.Messages, &req); err != nil {
 		return ConversationalRequest{}, err
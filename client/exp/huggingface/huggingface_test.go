@@ -2,7 +2,9 @@ package huggingface
 
 import (
 	"errors"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/ryszard/agency/client"
 	"github.com/stretchr/testify/assert"
@@ -21,10 +23,12 @@ func TestTranslateResponse(t *testing.T) {
 				GeneratedText: "Hello, I'm an AI.",
 			},
 			expected: client.ChatCompletionResponse{
-				Choices: []client.Message{
+				Choices: []client.Choice{
 					{
-						Content: "Hello, I'm an AI.",
-						Role:    "assistant",
+						Message: client.Message{
+							Content: "Hello, I'm an AI.",
+							Role:    "assistant",
+						},
 					},
 				},
 			},
@@ -62,6 +66,7 @@ func TestTranslateResponse(t *testing.T) {
 }
 
 func TestTranslateRequest(t *testing.T) {
+	temperature := float32(0.8)
 	clientReq := client.ChatCompletionRequest{
 		Model: "test-model",
 		Messages: []client.Message{
@@ -69,7 +74,7 @@ func TestTranslateRequest(t *testing.T) {
 			{Content: "How are you?", Role: "user"},
 		},
 		MaxTokens:   50,
-		Temperature: 0.8,
+		Temperature: &temperature,
 		CustomParams: map[string]interface{}{
 			"use_cache":          true,
 			"wait_for_model":     false,
@@ -86,7 +91,7 @@ func TestTranslateRequest(t *testing.T) {
 
 	assert.Equal(t, clientReq.Model, hfReq.Model)
 	assert.Equal(t, clientReq.MaxTokens, hfReq.Parameters.MaxLength) // Assuming MaxTokens corresponds to MaxLength
-	assert.InDelta(t, clientReq.Temperature, hfReq.Parameters.Temperature, 0.01)
+	assert.InDelta(t, temperature, hfReq.Parameters.Temperature, 0.01)
 
 	assert.Equal(t, clientReq.CustomParams["use_cache"], hfReq.Options.UseCache)
 	assert.Equal(t, clientReq.CustomParams["wait_for_model"], hfReq.Options.WaitForModel)
@@ -98,10 +103,11 @@ func TestTranslateRequest(t *testing.T) {
 }
 
 func TestTranslateRequestWithReservedCustomParams(t *testing.T) {
+	temperature := float32(0.5)
 	clientReq := client.ChatCompletionRequest{
 		Model:       "someModel",
 		MaxTokens:   5,
-		Temperature: 0.5,
+		Temperature: &temperature,
 		CustomParams: map[string]interface{}{
 			"max_length":  5,
 			"temperature": 0.5,
@@ -162,3 +168,64 @@ func TestTranslateRequestWithMessages(t *testing.T) {
 	}
 
 }
+
+func TestTranslateRequestRejectsContentParts(t *testing.T) {
+	_, err := TranslateRequest(client.ChatCompletionRequest{
+		Model: "someModel",
+		Messages: []client.Message{
+			{Content: "What's in this image?", Role: client.User, Parts: []client.ContentPart{client.ImageURLPart("https://example.com/cat.png")}},
+		},
+	})
+	assert.Error(t, err)
+}
+
+func TestTranslateRequestSamplingParams(t *testing.T) {
+	topK, topP := 50, float32(0.5)
+	req := client.ChatCompletionRequest{
+		Model:    "someModel",
+		Messages: []client.Message{{Content: "Hello", Role: client.User}},
+		TopK:     &topK,
+		TopP:     &topP,
+	}
+	hfReq, err := TranslateRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, hfReq.Parameters.TopK)
+	assert.Equal(t, 0.5, hfReq.Parameters.TopP)
+
+	req.Stop = []string{"\n"}
+	_, err = TranslateRequest(req)
+	assert.Error(t, err, "stop is not supported")
+}
+
+func TestTranslateFeatureExtractionResponse(t *testing.T) {
+	embeddings, err := TranslateFeatureExtractionResponse([]byte(`[[0.1, 0.2], [0.3, 0.4]]`))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{0.1, 0.2}, {0.3, 0.4}}, embeddings)
+
+	_, err = TranslateFeatureExtractionResponse([]byte(`{"error": "Model is loading"}`))
+	assert.EqualError(t, err, "Model is loading")
+
+	// Token level embeddings.
+	_, err = TranslateFeatureExtractionResponse([]byte(`[[[0.1, 0.2]]]`))
+	assert.Error(t, err)
+}
+
+func TestTranslateError(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable", Header: http.Header{}}
+	err := TranslateError(resp, []byte(`{"error": "Model gpt2 is currently loading", "estimated_time": 20.5}`))
+	var rerr *client.RetryableError
+	assert.ErrorAs(t, err, &rerr)
+	assert.Equal(t, 20500*time.Millisecond, rerr.RetryAfter())
+	assert.EqualError(t, errors.Unwrap(err), "Model gpt2 is currently loading")
+
+	resp = &http.Response{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests", Header: http.Header{"Retry-After": {"3"}}}
+	err = TranslateError(resp, []byte(`{"error": "Rate limit reached"}`))
+	assert.True(t, client.IsRateLimited(err))
+	assert.ErrorAs(t, err, &rerr)
+	assert.Equal(t, 3*time.Second, rerr.RetryAfter())
+
+	resp = &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Bad Request", Header: http.Header{}}
+	err = TranslateError(resp, []byte(`not json`))
+	assert.False(t, errors.As(err, &rerr))
+	assert.EqualError(t, err, "unexpected response status: 400 Bad Request")
+}
@@ -0,0 +1,436 @@
+// Package fake provides a scriptable client.Client for testing code that uses
+// agents, without talking to a provider and without a mocking library.
+//
+//	cl := fake.New()
+//	cl.On(fake.LastMessageContains("weather"), fake.Reply{Content: "Sunny."})
+//	cl.Enqueue(fake.Reply{Content: "Hello!"}, fake.Reply{Err: fake.ErrRateLimited})
+//	ag := agent.NewBaseAgent("test", agent.WithClient(cl))
+//	...
+//	cl.AssertRequestCount(t, 3)
+package fake
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryszard/agency/client"
+)
+
+// ErrNoReply is returned when there is no reply scripted for a request.
+var ErrNoReply = errors.New("fake: no reply scripted for the request")
+
+// ErrRateLimited and ErrServer are ready to use injected errors, which are
+// retryable (see client.RateLimited and client.Retryable).
+var (
+	ErrRateLimited = client.RateLimited(errors.New("fake: rate limited"))
+	ErrServer      = client.Retryable(errors.New("fake: server error"))
+)
+
+// Reply is a scripted answer to a request.
+type Reply struct {
+	// Content and ToolCalls make up the message of the response.
+	Content   string
+	ToolCalls []client.ToolCall
+	// FinishReason defaults to client.FinishReasonToolCalls if there are
+	// tool calls, and client.FinishReasonStop otherwise.
+	FinishReason client.FinishReason
+	Usage        client.Usage
+
+	// Err, if not nil, is returned instead of the response.
+	Err error
+	// Latency is how long to wait before answering, in addition to the
+	// latency of the Client.
+	Latency time.Duration
+}
+
+func (r Reply) response() client.ChatCompletionResponse {
+	finishReason := r.FinishReason
+	if finishReason == "" {
+		finishReason = client.FinishReasonStop
+		if len(r.ToolCalls) > 0 {
+			finishReason = client.FinishReasonToolCalls
+		}
+	}
+	return client.ChatCompletionResponse{
+		Choices: []client.Choice{{
+			Message: client.Message{
+				Role:      client.Assistant,
+				Content:   r.Content,
+				ToolCalls: r.ToolCalls,
+			},
+			FinishReason: finishReason,
+		}},
+		Usage: r.Usage,
+	}
+}
+
+// Matcher decides whether a rule applies to a request, based on its last
+// message.
+type Matcher func(last client.Message) bool
+
+// LastMessageContains matches requests whose last message contains s.
+func LastMessageContains(s string) Matcher {
+	return func(last client.Message) bool {
+		return strings.Contains(last.Text(), s)
+	}
+}
+
+// LastMessageIs matches requests whose last message is exactly content.
+func LastMessageIs(content string) Matcher {
+	return func(last client.Message) bool {
+		return last.Text() == content
+	}
+}
+
+type rule struct {
+	match Matcher
+	reply Reply
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithLatency makes the client wait for d before every answer.
+func WithLatency(d time.Duration) Option {
+	return func(c *Client) {
+		c.latency = d
+	}
+}
+
+// WithChunkSize sets the number of characters (runes) in each event of a
+// simulated stream. The default is 5.
+func WithChunkSize(n int) Option {
+	return func(c *Client) {
+		c.chunkSize = n
+	}
+}
+
+// WithParameters restricts the custom parameters accepted by the client
+// (see client.Validate) to params, to test how code deals with a provider
+// that doesn't support some of them.
+func WithParameters(params map[string]reflect.Type) Option {
+	return func(c *Client) {
+		c.params = params
+	}
+}
+
+// WithChunkDelay makes the client wait for d between the events of a
+// simulated stream.
+func WithChunkDelay(d time.Duration) Option {
+	return func(c *Client) {
+		c.chunkDelay = d
+	}
+}
+
+// Client is a scriptable client.Client. For every request, it answers with
+// the reply of the first rule (see On) that matches the last message, or else
+// the next reply in the queue (see Enqueue), or else the default reply (see
+// Default). If there is none, it returns ErrNoReply. It records every
+// request, so that tests can make assertions about them.
+//
+// Client implements client.StreamingClient, simulating streaming by splitting
+// the content in chunks, and client.Capabilities, supporting everything. It is
+// safe for concurrent use.
+type Client struct {
+	latency    time.Duration
+	chunkSize  int
+	chunkDelay time.Duration
+	params     map[string]reflect.Type
+
+	mu       sync.Mutex
+	rules    []rule
+	queue    []Reply
+	fallback *Reply
+	requests []client.ChatCompletionRequest
+}
+
+// New returns a Client without any replies scripted.
+func New(opts ...Option) *Client {
+	c := &Client{chunkSize: 5}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Enqueue adds replies to the queue. Each of them is used once, in order.
+func (c *Client) Enqueue(replies ...Reply) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queue = append(c.queue, replies...)
+	return c
+}
+
+// On makes the client answer with reply every time match matches a
+// request's last message. Rules are checked in the order they were added,
+// before the queue.
+func (c *Client) On(match Matcher, reply Reply) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = append(c.rules, rule{match: match, reply: reply})
+	return c
+}
+
+// Default sets the reply used when no rule matches and the queue is empty.
+func (c *Client) Default(reply Reply) *Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fallback = &reply
+	return c
+}
+
+// Requests returns the requests received so far.
+func (c *Client) Requests() []client.ChatCompletionRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]client.ChatCompletionRequest(nil), c.requests...)
+}
+
+// LastRequest returns the last request received. ok is false if there were
+// none.
+func (c *Client) LastRequest() (req client.ChatCompletionRequest, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.requests) == 0 {
+		return client.ChatCompletionRequest{}, false
+	}
+	return c.requests[len(c.requests)-1], true
+}
+
+// Pending returns the number of queued replies that haven't been used.
+func (c *Client) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queue)
+}
+
+// AssertRequestCount fails the test if the client didn't receive exactly n
+// requests.
+func (c *Client) AssertRequestCount(t testing.TB, n int) bool {
+	t.Helper()
+	if got := len(c.Requests()); got != n {
+		t.Errorf("fake: got %d requests, want %d", got, n)
+		return false
+	}
+	return true
+}
+
+// AssertLastMessage fails the test if the last message of the last request
+// received doesn't have the given content.
+func (c *Client) AssertLastMessage(t testing.TB, content string) bool {
+	t.Helper()
+	req, ok := c.LastRequest()
+	if !ok || len(req.Messages) == 0 {
+		t.Errorf("fake: no request with messages received")
+		return false
+	}
+	if got := req.Messages[len(req.Messages)-1].Text(); got != content {
+		t.Errorf("fake: last message is %q, want %q", got, content)
+		return false
+	}
+	return true
+}
+
+// AssertRequest fails the test if check returns false for any of the
+// requests received, or if there were none.
+func (c *Client) AssertRequest(t testing.TB, check func(req client.ChatCompletionRequest) bool) bool {
+	t.Helper()
+	requests := c.Requests()
+	if len(requests) == 0 {
+		t.Errorf("fake: no requests received")
+		return false
+	}
+	for i, req := range requests {
+		if !check(req) {
+			t.Errorf("fake: request %d doesn't pass the check: %+v", i, req)
+			return false
+		}
+	}
+	return true
+}
+
+// AssertDone fails the test if some queued replies weren't used.
+func (c *Client) AssertDone(t testing.TB) bool {
+	t.Helper()
+	if n := c.Pending(); n > 0 {
+		t.Errorf("fake: %d queued replies weren't used", n)
+		return false
+	}
+	return true
+}
+
+// reply records req and picks the reply for it.
+func (c *Client) reply(req client.ChatCompletionRequest) (Reply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, req)
+
+	var last client.Message
+	if len(req.Messages) > 0 {
+		last = req.Messages[len(req.Messages)-1]
+	}
+	for _, r := range c.rules {
+		if r.match(last) {
+			return r.reply, nil
+		}
+	}
+	if len(c.queue) > 0 {
+		reply := c.queue[0]
+		c.queue = c.queue[1:]
+		return reply, nil
+	}
+	if c.fallback != nil {
+		return *c.fallback, nil
+	}
+	return Reply{}, ErrNoReply
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// chunks splits s in chunks of at most n runes.
+func chunks(s string, n int) []string {
+	if n <= 0 {
+		return []string{s}
+	}
+	var out []string
+	runes := []rune(s)
+	for len(runes) > n {
+		out = append(out, string(runes[:n]))
+		runes = runes[n:]
+	}
+	if len(runes) > 0 {
+		out = append(out, string(runes))
+	}
+	return out
+}
+
+// CreateChatCompletion implements client.Client. If req.Stream is set, the
+// content is written to it in chunks, as by a streaming client.
+func (c *Client) CreateChatCompletion(ctx context.Context, req client.ChatCompletionRequest) (client.ChatCompletionResponse, error) {
+	reply, err := c.reply(req)
+	if err != nil {
+		return client.ChatCompletionResponse{}, err
+	}
+	if err := sleep(ctx, c.latency+reply.Latency); err != nil {
+		return client.ChatCompletionResponse{}, err
+	}
+	if reply.Err != nil {
+		return client.ChatCompletionResponse{}, reply.Err
+	}
+	if req.Stream != nil {
+		for _, chunk := range chunks(reply.Content, c.chunkSize) {
+			if err := sleep(ctx, c.chunkDelay); err != nil {
+				return client.ChatCompletionResponse{}, err
+			}
+			if _, err := io.WriteString(req.Stream, chunk); err != nil {
+				return client.ChatCompletionResponse{}, err
+			}
+		}
+	}
+	return reply.response(), nil
+}
+
+// CreateChatCompletionStream implements client.StreamingClient. The content
+// is split in chunks of the configured size, and the tool calls and usage
+// are sent with the last event.
+func (c *Client) CreateChatCompletionStream(ctx context.Context, req client.ChatCompletionRequest) (client.ChatCompletionStream, error) {
+	reply, err := c.reply(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := sleep(ctx, c.latency+reply.Latency); err != nil {
+		return nil, err
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+
+	var events []client.StreamEvent
+	for _, chunk := range chunks(reply.Content, c.chunkSize) {
+		events = append(events, client.StreamEvent{Content: chunk})
+	}
+	resp := reply.response()
+	last := client.StreamEvent{FinishReason: resp.Choices[0].FinishReason}
+	for i, call := range reply.ToolCalls {
+		last.ToolCalls = append(last.ToolCalls, client.ToolCallDelta{
+			Index:     i,
+			ID:        call.ID,
+			Name:      call.Name,
+			Arguments: call.Arguments,
+		})
+	}
+	if reply.Usage != (client.Usage{}) {
+		usage := reply.Usage
+		last.Usage = &usage
+	}
+	events = append(events, last)
+	return &stream{ctx: ctx, events: events, delay: c.chunkDelay}, nil
+}
+
+type stream struct {
+	ctx    context.Context
+	events []client.StreamEvent
+	delay  time.Duration
+}
+
+func (s *stream) Recv() (client.StreamEvent, error) {
+	if len(s.events) == 0 {
+		return client.StreamEvent{}, io.EOF
+	}
+	if err := sleep(s.ctx, s.delay); err != nil {
+		return client.StreamEvent{}, err
+	}
+	event := s.events[0]
+	s.events = s.events[1:]
+	return event, nil
+}
+
+func (s *stream) Close() error {
+	s.events = nil
+	return nil
+}
+
+// SupportsStreaming implements client.Capabilities.
+func (c *Client) SupportsStreaming() bool { return true }
+
+// SupportsTools implements client.Capabilities.
+func (c *Client) SupportsTools() bool { return true }
+
+// SupportsImages implements client.Capabilities.
+func (c *Client) SupportsImages() bool { return true }
+
+// SupportedParameters implements client.Capabilities. By default, the fake
+// accepts any custom parameters; see WithParameters.
+func (c *Client) SupportedParameters() map[string]reflect.Type {
+	if c.params != nil {
+		return c.params
+	}
+	return map[string]reflect.Type{client.AnyParameter: nil}
+}
+
+// MaxContextTokens implements client.Capabilities. Models are unknown to the
+// fake.
+func (c *Client) MaxContextTokens(model string) (int, bool) { return 0, false }
+
+var (
+	_ client.StreamingClient = (*Client)(nil)
+	_ client.Capabilities    = (*Client)(nil)
+)
@@ -0,0 +1,129 @@
+package fake_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryszard/agency/agent"
+	"github.com/ryszard/agency/client"
+	"github.com/ryszard/agency/client/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func request(content string) client.ChatCompletionRequest {
+	return client.ChatCompletionRequest{Messages: []client.Message{{Role: client.User, Content: content}}}
+}
+
+func TestClientScript(t *testing.T) {
+	ctx := context.Background()
+	cl := fake.New()
+	cl.On(fake.LastMessageContains("weather"), fake.Reply{Content: "Sunny."})
+	cl.Enqueue(fake.Reply{Content: "first"}, fake.Reply{Err: fake.ErrRateLimited})
+
+	resp, err := cl.CreateChatCompletion(ctx, request("How's the weather?"))
+	require.NoError(t, err)
+	assert.Equal(t, "Sunny.", resp.Choices[0].Content)
+
+	resp, err = cl.CreateChatCompletion(ctx, request("Hi"))
+	require.NoError(t, err)
+	assert.Equal(t, "first", resp.Choices[0].Content)
+	assert.Equal(t, client.FinishReasonStop, resp.Choices[0].FinishReason)
+
+	_, err = cl.CreateChatCompletion(ctx, request("Hi"))
+	assert.True(t, client.IsRateLimited(err))
+
+	_, err = cl.CreateChatCompletion(ctx, request("Hi"))
+	assert.ErrorIs(t, err, fake.ErrNoReply)
+
+	cl.Default(fake.Reply{Content: "default"})
+	resp, err = cl.CreateChatCompletion(ctx, request("Hi"))
+	require.NoError(t, err)
+	assert.Equal(t, "default", resp.Choices[0].Content)
+
+	cl.AssertRequestCount(t, 5)
+	cl.AssertLastMessage(t, "Hi")
+	cl.AssertDone(t)
+}
+
+func TestClientStreaming(t *testing.T) {
+	ctx := context.Background()
+	cl := fake.New(fake.WithChunkSize(3))
+	cl.Enqueue(
+		fake.Reply{Content: "Hello there", Usage: client.Usage{TotalTokens: 5}},
+		fake.Reply{ToolCalls: []client.ToolCall{{ID: "1", Name: "search", Arguments: `{"q":"go"}`}}},
+		fake.Reply{Content: "written"},
+	)
+
+	stream, err := cl.CreateChatCompletionStream(ctx, request("Hi"))
+	require.NoError(t, err)
+	first, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "Hel", first.Content)
+	resp, err := client.CollectStream(stream, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "lo there", resp.Choices[0].Content)
+	assert.Equal(t, 5, resp.Usage.TotalTokens)
+
+	stream, err = cl.CreateChatCompletionStream(ctx, request("Search"))
+	require.NoError(t, err)
+	resp, err = client.CollectStream(stream, nil)
+	require.NoError(t, err)
+	assert.Equal(t, client.FinishReasonToolCalls, resp.Choices[0].FinishReason)
+	assert.Equal(t, "search", resp.Choices[0].ToolCalls[0].Name)
+
+	var sb strings.Builder
+	req := request("Hi")
+	req.Stream = &sb
+	_, err = cl.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "written", sb.String())
+}
+
+func TestClientLatency(t *testing.T) {
+	cl := fake.New(fake.WithLatency(time.Second)).Default(fake.Reply{Content: "slow"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := cl.CreateChatCompletion(ctx, request("Hi"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClientWithAgent(t *testing.T) {
+	cl := fake.New().Enqueue(fake.Reply{Content: "Hello, human."})
+	ag := agent.NewBaseAgent("greeter", agent.WithClient(cl), agent.WithModel("test-model"))
+	ag.System("You greet people.")
+	_, err := ag.Listen("Hi!")
+	require.NoError(t, err)
+
+	answer, err := ag.Respond(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Hello, human.", answer)
+	cl.AssertLastMessage(t, "Hi!")
+	cl.AssertRequest(t, func(req client.ChatCompletionRequest) bool {
+		return req.Model == "test-model" && len(req.Messages) == 2
+	})
+}
+
+func TestClientCustomParams(t *testing.T) {
+	cl := fake.New().Default(fake.Reply{Content: "ok"})
+	ag := agent.NewBaseAgent("tuned", agent.WithClient(cl), agent.WithCustomParams(map[string]interface{}{
+		"logit_bias": map[string]int{"50256": -100},
+		"top_k":      40,
+	}))
+	_, err := ag.Listen("Hi!")
+	require.NoError(t, err)
+	_, err = ag.Respond(context.Background())
+	require.NoError(t, err)
+	cl.AssertRequest(t, func(req client.ChatCompletionRequest) bool {
+		return req.CustomParams["top_k"] == 40
+	})
+
+	strict := fake.New(fake.WithParameters(map[string]reflect.Type{"top_k": reflect.TypeOf(0)})).Default(fake.Reply{Content: "ok"})
+	err = client.Validate(strict, client.ChatCompletionRequest{CustomParams: map[string]interface{}{"top_k": 40}})
+	assert.NoError(t, err)
+	err = client.Validate(strict, client.ChatCompletionRequest{CustomParams: map[string]interface{}{"logit_bias": 1}})
+	assert.ErrorIs(t, err, client.ErrUnsupported)
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Backend is one of the clients used by Fallback.
+type Backend struct {
+	// Name identifies the backend in the response metadata and in logs. If
+	// it is empty, the type of Client is used.
+	Name   string
+	Client Client
+	// Models maps the models requested by the caller to the models that
+	// should be used with this backend, for example "gpt-4" to "claude-v1".
+	// Models that are not in the map are passed unchanged.
+	Models map[string]string
+	// Timeout is the deadline for a request to this backend. If it is
+	// exceeded, the next backend is tried. Zero means no deadline.
+	Timeout time.Duration
+}
+
+func (b Backend) name() string {
+	if b.Name != "" {
+		return b.Name
+	}
+	return fmt.Sprintf("%T", b.Client)
+}
+
+type fallbackClient struct {
+	backends []Backend
+}
+
+// Fallback returns a client that sends requests to primary, and if it fails
+// with a retryable error, a network error, an open circuit (see
+// CircuitBreaking) or exceeds its timeout, tries the secondaries in order.
+// Other errors are returned immediately. The name of the backend that
+// answered is stored in the response metadata under MetadataBackend. Note
+// that if a backend fails in the middle of streaming, the next backend will
+// stream its whole response to the same writer.
+//
+// Streams made with CreateChatCompletionStream only fall back if opening the
+// stream fails, as the events already received can't be taken back; backends
+// that are not a StreamingClient are skipped.
+func Fallback(primary Backend, secondaries ...Backend) Client {
+	backends := append([]Backend{primary}, secondaries...)
+	for _, b := range backends {
+		if b.Client == nil {
+			panic("client must not be nil")
+		}
+	}
+	return &fallbackClient{backends: backends}
+}
+
+func (client *fallbackClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	var lastErr error
+	for _, backend := range client.backends {
+		resp, err := backend.send(ctx, req)
+		if err == nil {
+			resp.SetMetadata(MetadataBackend, backend.name())
+			return resp, nil
+		}
+		if ctx.Err() != nil || !isBackendFailure(err) {
+			return ChatCompletionResponse{}, err
+		}
+		log.WithError(err).WithField("backend", backend.name()).Warn("Backend failed, falling back")
+		lastErr = err
+	}
+	return ChatCompletionResponse{}, fmt.Errorf("all backends failed, last error: %w", lastErr)
+}
+
+// CreateChatCompletionStream implements StreamingClient.
+func (client *fallbackClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	var lastErr error
+	for _, backend := range client.backends {
+		stream, err := backend.openStream(ctx, req)
+		if err == nil {
+			return stream, nil
+		}
+		if errors.Is(err, ErrStreamingNotSupported) {
+			continue
+		}
+		if ctx.Err() != nil || !isBackendFailure(err) {
+			return nil, err
+		}
+		log.WithError(err).WithField("backend", backend.name()).Warn("Backend failed, falling back")
+		lastErr = err
+	}
+	if lastErr == nil {
+		return nil, ErrStreamingNotSupported
+	}
+	return nil, fmt.Errorf("all backends failed, last error: %w", lastErr)
+}
+
+// send sends req to the backend, mapping the model and applying the timeout.
+func (backend Backend) send(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	if model, ok := backend.Models[req.Model]; ok {
+		req.Model = model
+	}
+	if backend.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, backend.Timeout)
+		defer cancel()
+	}
+	return backend.Client.CreateChatCompletion(ctx, req)
+}
+
+// openStream is like send, but opens a stream. The timeout applies to the
+// whole stream.
+func (backend Backend) openStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := backend.Client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	if model, ok := backend.Models[req.Model]; ok {
+		req.Model = model
+	}
+	if backend.Timeout <= 0 {
+		return streaming.CreateChatCompletionStream(ctx, req)
+	}
+	ctx, cancel := context.WithTimeout(ctx, backend.Timeout)
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// queuedStream calls cancel once the stream ends or is closed.
+	return &queuedStream{ChatCompletionStream: stream, release: cancel}, nil
+}
+
+// isBackendFailure returns true for errors that indicate a problem with the
+// backend rather than with the request.
+func isBackendFailure(err error) bool {
+	var rerr *RetryableError
+	var netErr net.Error
+	var openErr *CircuitOpenError
+	return errors.As(err, &rerr) || errors.As(err, &netErr) || errors.As(err, &openErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Unwrap implements Wrapper, returning the primary client.
+func (client *fallbackClient) Unwrap() Client {
+	return client.backends[0].Client
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type funcClient func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error)
+
+func (f funcClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	return f(ctx, req)
+}
+
+func answering(content string) funcClient {
+	return func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		return ChatCompletionResponse{Choices: []Choice{{Message: Message{Role: Assistant, Content: content + ":" + req.Model}}}}, nil
+	}
+}
+
+func failing(err error) funcClient {
+	return func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		return ChatCompletionResponse{}, err
+	}
+}
+
+// streamingFunc is a StreamingClient that opens streams with a function.
+type streamingFunc func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error)
+
+func (f streamingFunc) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	stream, err := f(ctx, req)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	return CollectStream(stream, nil)
+}
+
+func (f streamingFunc) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	return f(ctx, req)
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	req := ChatCompletionRequest{Model: "gpt-4"}
+
+	// The primary is fine.
+	cl := Fallback(Backend{Name: "primary", Client: answering("primary")}, Backend{Name: "secondary", Client: answering("secondary")})
+	resp, err := cl.CreateChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "primary:gpt-4", resp.Choices[0].Content)
+	assert.Equal(t, "primary", resp.Metadata[MetadataBackend])
+
+	// The primary returns a retryable error, and the secondary maps the model.
+	cl = Fallback(
+		Backend{Name: "primary", Client: failing(Retryable(errors.New("overloaded")))},
+		Backend{Name: "secondary", Client: answering("secondary"), Models: map[string]string{"gpt-4": "claude-v1"}},
+	)
+	resp, err = cl.CreateChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "secondary:claude-v1", resp.Choices[0].Content)
+	assert.Equal(t, "secondary", resp.Metadata[MetadataBackend])
+
+	// The primary is too slow.
+	slow := funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		<-ctx.Done()
+		return ChatCompletionResponse{}, ctx.Err()
+	})
+	cl = Fallback(Backend{Name: "slow", Client: slow, Timeout: 10 * time.Millisecond}, Backend{Name: "fast", Client: answering("fast")})
+	resp, err = cl.CreateChatCompletion(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "fast", resp.Metadata[MetadataBackend])
+
+	// Non-retryable errors are returned immediately.
+	invalid := errors.New("invalid request")
+	cl = Fallback(Backend{Client: failing(invalid)}, Backend{Client: answering("secondary")})
+	_, err = cl.CreateChatCompletion(ctx, req)
+	assert.Equal(t, invalid, err)
+
+	// All backends fail.
+	cl = Fallback(Backend{Client: failing(Retryable(errors.New("1")))}, Backend{Client: failing(Retryable(errors.New("2")))})
+	_, err = cl.CreateChatCompletion(ctx, req)
+	assert.ErrorContains(t, err, "all backends failed")
+}
+
+func TestFallbackStreams(t *testing.T) {
+	ctx := context.Background()
+	req := ChatCompletionRequest{Model: "gpt-4"}
+
+	overloaded := streamingFunc(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+		return nil, Retryable(errors.New("overloaded"))
+	})
+	cl := Fallback(
+		Backend{Name: "primary", Client: overloaded},
+		Backend{Name: "plain", Client: answering("plain")},
+		Backend{Name: "secondary", Client: streamingAnswering{funcClient: answering("unused"), content: "hello there"}},
+	).(StreamingClient)
+	stream, err := cl.CreateChatCompletionStream(ctx, req)
+	assert.NoError(t, err)
+	resp, err := CollectStream(stream, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello there", resp.Choices[0].Content)
+
+	// Non-retryable errors are returned immediately.
+	invalid := errors.New("invalid request")
+	cl = Fallback(
+		Backend{Client: streamingFunc(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+			return nil, invalid
+		})},
+		Backend{Client: streamingAnswering{funcClient: answering("unused"), content: "hello"}},
+	).(StreamingClient)
+	_, err = cl.CreateChatCompletionStream(ctx, req)
+	assert.Equal(t, invalid, err)
+
+	// None of the backends can stream.
+	cl = Fallback(Backend{Client: answering("a")}, Backend{Client: answering("b")}).(StreamingClient)
+	_, err = cl.CreateChatCompletionStream(ctx, req)
+	assert.ErrorIs(t, err, ErrStreamingNotSupported)
+}
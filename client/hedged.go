@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MetadataHedged is the key of the response metadata that Hedged sets to
+// "true" when the response came from the hedge request.
+const MetadataHedged = "hedged"
+
+// HedgePolicy configures Hedged.
+type HedgePolicy struct {
+	// Percentile of the recent latencies of successful requests to the
+	// primary client after which the hedge request is sent, like 0.95.
+	Percentile float64
+	// Window is the number of recent latencies the percentile is computed
+	// from. The default is 100.
+	Window int
+	// MinSamples is the number of latencies needed before the percentile
+	// is used. The default is 10. Until then, InitialDelay is used, and if
+	// it's zero requests are not hedged.
+	MinSamples   int
+	InitialDelay time.Duration
+	// MinDelay is a lower bound for the delay, so that a fast provider
+	// doesn't get every request twice.
+	MinDelay time.Duration
+	// Hedge is where the hedge request is sent. If its Client is nil, it is
+	// sent to the primary client again.
+	Hedge Backend
+}
+
+type hedgedClient struct {
+	primary Backend
+	policy  HedgePolicy
+	// toOther is true if hedge requests go to a different backend.
+	toOther bool
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+// Hedged wraps a Client to reduce tail latency: if a request hasn't returned
+// after the delay given by policy, a duplicate request is sent (to
+// policy.Hedge, if set) and the first successful response is returned, the
+// other request being canceled. If a request fails before the delay, its
+// error is returned without hedging; use Fallback or Retrying for failures.
+//
+// Requests with Stream set are not hedged, as both responses would be written
+// to the same writer, and neither are requests made with
+// CreateChatCompletionStream.
+func Hedged(client Client, policy HedgePolicy) Client {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	if policy.Percentile <= 0 || policy.Percentile > 1 {
+		panic("percentile must be in (0, 1]")
+	}
+	if policy.Window <= 0 {
+		policy.Window = 100
+	}
+	if policy.MinSamples <= 0 {
+		policy.MinSamples = 10
+	}
+	toOther := policy.Hedge.Client != nil
+	if !toOther {
+		policy.Hedge.Client = client
+	}
+	return &hedgedClient{
+		primary: Backend{Name: "primary", Client: client},
+		policy:  policy,
+		toOther: toOther,
+	}
+}
+
+// observe records the latency of a successful request.
+func (client *hedgedClient) observe(latency time.Duration) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.latencies) < client.policy.Window {
+		client.latencies = append(client.latencies, latency)
+		return
+	}
+	client.latencies[client.next] = latency
+	client.next = (client.next + 1) % client.policy.Window
+}
+
+// delay returns how long to wait before hedging. ok is false if requests
+// shouldn't be hedged.
+func (client *hedgedClient) delay() (delay time.Duration, ok bool) {
+	client.mu.Lock()
+	if len(client.latencies) < client.policy.MinSamples {
+		client.mu.Unlock()
+		if client.policy.InitialDelay <= 0 {
+			return 0, false
+		}
+		delay = client.policy.InitialDelay
+	} else {
+		sorted := append([]time.Duration(nil), client.latencies...)
+		client.mu.Unlock()
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(math.Ceil(client.policy.Percentile*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		delay = sorted[i]
+	}
+	if delay < client.policy.MinDelay {
+		delay = client.policy.MinDelay
+	}
+	return delay, true
+}
+
+type hedgeResult struct {
+	resp   ChatCompletionResponse
+	err    error
+	hedged bool
+}
+
+func (client *hedgedClient) send(ctx context.Context, backend Backend, req ChatCompletionRequest, hedged bool, results chan<- hedgeResult) {
+	resp, err := backend.send(ctx, req)
+	results <- hedgeResult{resp: resp, err: err, hedged: hedged}
+}
+
+func (client *hedgedClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	delay, ok := client.delay()
+	if req.WantsStreaming() || !ok {
+		start := time.Now()
+		resp, err := client.primary.Client.CreateChatCompletion(ctx, req)
+		if err == nil {
+			client.observe(time.Since(start))
+		}
+		return resp, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	// Canceling the context stops the request that lost.
+	defer cancel()
+	// Buffered, so that the loser doesn't block.
+	results := make(chan hedgeResult, 2)
+	start := time.Now()
+	go client.send(ctx, client.primary, req, false, results)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			log.WithField("delay", delay).WithField("backend", client.policy.Hedge.name()).Debug("Hedging request")
+			pending++
+			go client.send(ctx, client.policy.Hedge, req, true, results)
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Only the latencies of the primary are observed, as the
+				// hedge may be a different backend. If the primary lost, how
+				// long it had been running is a lower bound of its latency;
+				// leaving it out would leave out the slow tail, and the delay
+				// would keep shrinking.
+				client.observe(time.Since(start))
+				if result.hedged {
+					result.resp.SetMetadata(MetadataHedged, "true")
+					if client.toOther {
+						result.resp.SetMetadata(MetadataBackend, client.policy.Hedge.name())
+					}
+				}
+				return result.resp, nil
+			}
+			if pending == 0 {
+				return ChatCompletionResponse{}, result.err
+			}
+			// The other request may still succeed.
+			log.WithError(result.err).Debug("Hedged request failed, waiting for the other one")
+		}
+	}
+}
+
+// CreateChatCompletionStream implements StreamingClient. Streams are not
+// hedged.
+func (client *hedgedClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.primary.Client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	return streaming.CreateChatCompletionStream(ctx, req)
+}
+
+// Unwrap implements Wrapper, returning the primary client.
+func (client *hedgedClient) Unwrap() Client {
+	return client.primary.Client
+}
+
+// WithHedging is the Middleware version of Hedged.
+func WithHedging(policy HedgePolicy) Middleware {
+	return func(client Client) Client {
+		return Hedged(client, policy)
+	}
+}
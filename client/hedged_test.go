@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sleepingClient answers after d, unless the context is done first, in which
+// case it reports the cancellation on canceled.
+func sleepingClient(d time.Duration, content string, canceled chan<- struct{}) funcClient {
+	return func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		select {
+		case <-time.After(d):
+			return answering(content)(ctx, req)
+		case <-ctx.Done():
+			if canceled != nil {
+				canceled <- struct{}{}
+			}
+			return ChatCompletionResponse{}, ctx.Err()
+		}
+	}
+}
+
+func TestHedgedSendsToHedgeWhenSlow(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	cl := Hedged(sleepingClient(time.Minute, "slow", canceled), HedgePolicy{
+		Percentile:   0.9,
+		InitialDelay: 10 * time.Millisecond,
+		Hedge:        Backend{Name: "fast", Client: answering("fast")},
+	})
+
+	resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+	require.NoError(t, err)
+	assert.Equal(t, "fast:m", resp.Choices[0].Content)
+	assert.Equal(t, "true", resp.Metadata[MetadataHedged])
+	assert.Equal(t, "fast", resp.Metadata[MetadataBackend])
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the slow request wasn't canceled")
+	}
+}
+
+func TestHedgedFastRequestsAreNotHedged(t *testing.T) {
+	hedge := &switchClient{}
+	cl := Hedged(answering("primary"), HedgePolicy{
+		Percentile:   0.9,
+		InitialDelay: time.Second,
+		Hedge:        Backend{Client: hedge},
+	})
+	resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+	require.NoError(t, err)
+	assert.Equal(t, "primary:m", resp.Choices[0].Content)
+	assert.Empty(t, resp.Metadata[MetadataHedged])
+	assert.Equal(t, 0, hedge.calls)
+}
+
+func TestHedgedWaitsForTheOtherRequestOnFailure(t *testing.T) {
+	slowFailure := func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		time.Sleep(20 * time.Millisecond)
+		return ChatCompletionResponse{}, errors.New("boom")
+	}
+	cl := Hedged(funcClient(slowFailure), HedgePolicy{
+		Percentile:   0.9,
+		InitialDelay: time.Millisecond,
+		Hedge:        Backend{Client: sleepingClient(50*time.Millisecond, "hedge", nil)},
+	})
+	resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+	require.NoError(t, err)
+	assert.Equal(t, "hedge:m", resp.Choices[0].Content)
+}
+
+func TestHedgedDelay(t *testing.T) {
+	cl := Hedged(answering("x"), HedgePolicy{Percentile: 0.9, MinSamples: 10, MinDelay: 5 * time.Millisecond}).(*hedgedClient)
+	_, ok := cl.delay()
+	assert.False(t, ok, "no hedging without samples or an initial delay")
+
+	for i := 1; i <= 10; i++ {
+		cl.observe(time.Duration(i) * 10 * time.Millisecond)
+	}
+	delay, ok := cl.delay()
+	assert.True(t, ok)
+	assert.Equal(t, 90*time.Millisecond, delay)
+
+	for i := 0; i < 100; i++ {
+		cl.observe(time.Millisecond)
+	}
+	delay, _ = cl.delay()
+	assert.Equal(t, 5*time.Millisecond, delay)
+}
+
+func TestHedgedDelayDoesNotShrinkWithASlowPrimary(t *testing.T) {
+	cl := Hedged(sleepingClient(time.Minute, "slow", nil), HedgePolicy{
+		Percentile:   0.5,
+		MinSamples:   3,
+		InitialDelay: 10 * time.Millisecond,
+		Hedge:        Backend{Name: "fast", Client: answering("fast")},
+	}).(*hedgedClient)
+
+	for i := 0; i < 10; i++ {
+		resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+		require.NoError(t, err)
+		assert.Equal(t, "fast:m", resp.Choices[0].Content)
+	}
+	// The fast hedge latencies are not counted, and the primary took at
+	// least the initial delay every time.
+	delay, ok := cl.delay()
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, delay, 10*time.Millisecond)
+}
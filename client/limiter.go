@@ -34,3 +34,20 @@ func (client *rateLimitingClient) CreateChatCompletion(ctx context.Context, req
 	}
 	return client.client.CreateChatCompletion(ctx, req)
 }
+
+// CreateChatCompletionStream implements StreamingClient.
+func (client *rateLimitingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	if err := client.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return streaming.CreateChatCompletionStream(ctx, req)
+}
+
+// Unwrap implements Wrapper.
+func (client *rateLimitingClient) Unwrap() Client {
+	return client.client
+}
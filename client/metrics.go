@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the buckets of
+// the latency histogram used by NewMetrics.
+var DefaultLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// histogram is a Prometheus style histogram, with cumulative buckets.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(buckets []float64, value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, bound := range buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Metrics collects metrics about the requests made through the clients
+// returned by Measured, and serves them over HTTP in the Prometheus text
+// format. One Metrics can be shared by many clients.
+type Metrics struct {
+	buckets []float64
+
+	mu          sync.Mutex
+	requests    map[string]float64
+	errors      map[string]float64
+	latency     map[string]*histogram
+	tokens      map[string]float64
+	cacheHits   map[string]float64
+	cacheMisses map[string]float64
+}
+
+// NewMetrics returns an empty Metrics, with latency buckets (in seconds)
+// given by buckets, or DefaultLatencyBuckets if there are none.
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		buckets:     buckets,
+		requests:    make(map[string]float64),
+		errors:      make(map[string]float64),
+		latency:     make(map[string]*histogram),
+		tokens:      make(map[string]float64),
+		cacheHits:   make(map[string]float64),
+		cacheMisses: make(map[string]float64),
+	}
+}
+
+// labels renders Prometheus labels, in the order given.
+func labels(pairs ...string) string {
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		fmt.Fprintf(&sb, `%s="%s"`, pairs[i], value)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// ErrorClass returns a short description of the kind of err, used to label
+// the error metrics: "rate_limited", "retryable", "circuit_open",
+// "budget_exceeded", "timeout", "canceled", "network" or "other".
+func ErrorClass(err error) string {
+	var rerr *RetryableError
+	var openErr *CircuitOpenError
+	var budgetErr *BudgetExceededError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &rerr) && rerr.rateLimited:
+		return "rate_limited"
+	case errors.As(err, &rerr):
+		return "retryable"
+	case errors.As(err, &openErr):
+		return "circuit_open"
+	case errors.As(err, &budgetErr):
+		return "budget_exceeded"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// observe records a finished request.
+func (m *Metrics) observe(provider, model, agent string, latency time.Duration, resp ChatCompletionResponse, err error) {
+	key := labels("provider", provider, "model", model, "agent", agent)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[key]++
+	if err != nil {
+		m.errors[labels("provider", provider, "model", model, "agent", agent, "class", ErrorClass(err))]++
+		return
+	}
+	if m.latency[key] == nil {
+		m.latency[key] = &histogram{}
+	}
+	m.latency[key].observe(m.buckets, latency.Seconds())
+	m.tokens[labels("provider", provider, "model", model, "agent", agent, "type", "prompt")] += float64(resp.Usage.PromptTokens)
+	m.tokens[labels("provider", provider, "model", model, "agent", agent, "type", "completion")] += float64(resp.Usage.CompletionTokens)
+	switch resp.Metadata[MetadataCache] {
+	case "hit":
+		m.cacheHits[key]++
+	case "miss":
+		m.cacheMisses[key]++
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sb strings.Builder
+	writeCounter(&sb, "agency_requests_total", "Chat completion requests.", m.requests)
+	writeCounter(&sb, "agency_errors_total", "Chat completion requests that failed, by error class.", m.errors)
+	writeCounter(&sb, "agency_tokens_total", "Tokens used by chat completion requests, by type.", m.tokens)
+	writeCounter(&sb, "agency_cache_hits_total", "Chat completion requests answered from the cache.", m.cacheHits)
+	writeCounter(&sb, "agency_cache_misses_total", "Chat completion requests not found in the cache.", m.cacheMisses)
+
+	ratios := make(map[string]float64)
+	for key, hits := range m.cacheHits {
+		ratios[key] = hits / (hits + m.cacheMisses[key])
+	}
+	for key := range m.cacheMisses {
+		if _, ok := ratios[key]; !ok {
+			ratios[key] = 0
+		}
+	}
+	writeMetric(&sb, "agency_cache_hit_ratio", "gauge", "Fraction of chat completion requests answered from the cache.", ratios)
+
+	fmt.Fprintf(&sb, "# HELP agency_request_duration_seconds Latency of successful chat completion requests.\n")
+	fmt.Fprintf(&sb, "# TYPE agency_request_duration_seconds histogram\n")
+	for _, key := range sortedKeys(m.latency) {
+		h := m.latency[key]
+		// Add the le label to the other labels.
+		prefix := strings.TrimSuffix(key, "}") + ","
+		for i, bound := range m.buckets {
+			fmt.Fprintf(&sb, "agency_request_duration_seconds_bucket%sle=\"%g\"} %d\n", prefix, bound, h.counts[i])
+		}
+		fmt.Fprintf(&sb, "agency_request_duration_seconds_bucket%sle=\"+Inf\"} %d\n", prefix, h.count)
+		fmt.Fprintf(&sb, "agency_request_duration_seconds_sum%s %g\n", key, h.sum)
+		fmt.Fprintf(&sb, "agency_request_duration_seconds_count%s %d\n", key, h.count)
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func writeCounter(sb *strings.Builder, name, help string, values map[string]float64) {
+	writeMetric(sb, name, "counter", help, values)
+}
+
+func writeMetric(sb *strings.Builder, name, typ, help string, values map[string]float64) {
+	fmt.Fprintf(sb, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(sb, "# TYPE %s %s\n", name, typ)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(sb, "%s%s %g\n", name, key, values[key])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ServeHTTP implements http.Handler, serving the metrics to be scraped by
+// Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+type measuredClient struct {
+	client   Client
+	metrics  *Metrics
+	provider string
+}
+
+// Measured wraps a Client and records metrics about its requests in metrics:
+// request and error counts, latency, token usage and cache hits, labeled with
+// provider, the model and the agent name (see WithAgentName). To count cache
+// hits, Measured has to wrap the CachedClient.
+func Measured(client Client, metrics *Metrics, provider string) Client {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	return &measuredClient{
+		client:   client,
+		metrics:  metrics,
+		provider: provider,
+	}
+}
+
+// WithMetrics is the Middleware version of Measured.
+func WithMetrics(metrics *Metrics, provider string) Middleware {
+	return func(client Client) Client {
+		return Measured(client, metrics, provider)
+	}
+}
+
+func (client *measuredClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	start := time.Now()
+	resp, err := client.client.CreateChatCompletion(ctx, req)
+	client.metrics.observe(client.provider, req.Model, AgentName(ctx), time.Since(start), resp, err)
+	return resp, err
+}
+
+// CreateChatCompletionStream implements StreamingClient. The request is
+// recorded when the stream ends.
+func (client *measuredClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	start := time.Now()
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		client.metrics.observe(client.provider, req.Model, AgentName(ctx), time.Since(start), ChatCompletionResponse{}, err)
+		return nil, err
+	}
+	return &measuredStream{
+		ChatCompletionStream: stream,
+		done: func(resp ChatCompletionResponse, err error) {
+			client.metrics.observe(client.provider, req.Model, AgentName(ctx), time.Since(start), resp, err)
+		},
+	}, nil
+}
+
+// measuredStream calls done once, when the stream ends or is closed.
+type measuredStream struct {
+	ChatCompletionStream
+	done     func(ChatCompletionResponse, error)
+	acc      StreamAccumulator
+	finished bool
+}
+
+func (s *measuredStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err == nil {
+		s.acc.Add(event)
+	} else if !s.finished {
+		s.finished = true
+		if err == io.EOF {
+			s.done(s.acc.Response(), nil)
+		} else {
+			s.done(ChatCompletionResponse{}, err)
+		}
+	}
+	return event, err
+}
+
+func (s *measuredStream) Close() error {
+	// A stream closed early is measured as far as it was read.
+	if !s.finished {
+		s.finished = true
+		s.done(s.acc.Response(), nil)
+	}
+	return s.ChatCompletionStream.Close()
+}
+
+// Unwrap implements Wrapper.
+func (client *measuredClient) Unwrap() Client {
+	return client.client
+}
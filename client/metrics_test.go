@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ryszard/agency/util/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeasured(t *testing.T) {
+	metrics := NewMetrics(1, 10)
+	cl := Chain(usedClient(0),
+		WithMetrics(metrics, "fake"),
+		WithCache(cache.Memory()),
+	)
+	ctx := WithAgentName(context.Background(), "poet")
+
+	for i := 0; i < 3; i++ {
+		_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m"})
+		assert.NoError(t, err)
+	}
+
+	failing := Measured(failing(RateLimited(errors.New("429"))), metrics, "other")
+	_, err := failing.CreateChatCompletion(ctx, ChatCompletionRequest{Model: "m"})
+	assert.Error(t, err)
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	text := string(body)
+
+	for _, line := range []string{
+		`agency_requests_total{provider="fake",model="m",agent="poet"} 3`,
+		`agency_requests_total{provider="other",model="m",agent="poet"} 1`,
+		`agency_errors_total{provider="other",model="m",agent="poet",class="rate_limited"} 1`,
+		`agency_cache_hits_total{provider="fake",model="m",agent="poet"} 2`,
+		`agency_cache_misses_total{provider="fake",model="m",agent="poet"} 1`,
+		`agency_request_duration_seconds_bucket{provider="fake",model="m",agent="poet",le="1"} 3`,
+		`agency_request_duration_seconds_bucket{provider="fake",model="m",agent="poet",le="+Inf"} 3`,
+		`agency_request_duration_seconds_count{provider="fake",model="m",agent="poet"} 3`,
+		"# TYPE agency_request_duration_seconds histogram",
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+	assert.Regexp(t, `agency_cache_hit_ratio\{provider="fake",model="m",agent="poet"\} 0\.66`, text)
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{RateLimited(errors.New("429")), "rate_limited"},
+		{Retryable(errors.New("500")), "retryable"},
+		{&CircuitOpenError{}, "circuit_open"},
+		{&BudgetExceededError{}, "budget_exceeded"},
+		{context.DeadlineExceeded, "timeout"},
+		{context.Canceled, "canceled"},
+		{errors.New("invalid request"), "other"},
+	} {
+		assert.Equal(t, tc.want, ErrorClass(tc.err), "%v", tc.err)
+	}
+}
+
+func TestLabelsEscaping(t *testing.T) {
+	assert.Equal(t, `{agent="say \"hi\"\\\n"}`, labels("agent", "say \"hi\"\\\n"))
+}
+
+func TestMeasuredStreams(t *testing.T) {
+	metrics := NewMetrics(1, 10)
+	cl := Measured(streamingAnswering{funcClient: answering("unused"), content: "one two three"}, metrics, "fake").(StreamingClient)
+
+	// One stream is read to the end, and the other one is closed early.
+	stream, err := cl.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	_, err = CollectStream(stream, nil)
+	assert.NoError(t, err)
+	stream, err = cl.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "m"})
+	assert.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+	stream.Close()
+	stream.Close()
+
+	var sb strings.Builder
+	_, err = metrics.WriteTo(&sb)
+	assert.NoError(t, err)
+	assert.Contains(t, sb.String(), `agency_requests_total{provider="fake",model="m",agent=""} 2`+"\n")
+}
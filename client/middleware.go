@@ -0,0 +1,166 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Middleware wraps a Client to add some behavior, like caching or retrying.
+type Middleware func(Client) Client
+
+// Chain wraps base with the middlewares. The first middleware is the
+// outermost one, so requests go through the middlewares in the order they are
+// passed, and then reach base: Chain(base, a, b) is a(b(base)).
+//
+// The order matters. A good order for the middlewares provided by this
+// package is:
+//
+//	client.Chain(base,
+//		client.WithCache(cache),                  // Cache hits skip everything else.
+//		client.WithRetries(time.Second, time.Minute, 10),
+//		client.WithRateLimiter(limiter),          // Every attempt waits for the limiter.
+//	)
+//
+// Putting WithCache inside WithRetries works, but then the cache is checked
+// again before every retry (cache errors are not retried, though). Putting
+// WithRateLimiter outside WithRetries makes the retries of a request bypass
+// the limiter, which makes things worse when the provider is rate limiting.
+// Wrappers that react to failures, like CircuitBreaking and Pool, should also
+// go inside WithRetries, so that they see every attempt.
+func Chain(base Client, mws ...Middleware) Client {
+	if base == nil {
+		panic("client must not be nil")
+	}
+	cl := base
+	for i := len(mws) - 1; i >= 0; i-- {
+		cl = mws[i](cl)
+	}
+	return cl
+}
+
+// WithCache is the Middleware version of Cached.
+func WithCache(cache Cache, opts ...CacheOption) Middleware {
+	return func(client Client) Client {
+		return Cached(client, cache, opts...)
+	}
+}
+
+// WithRetries is the Middleware version of Retrying.
+func WithRetries(baseWait time.Duration, maxWait time.Duration, maxRetries int, opts ...RetryOption) Middleware {
+	return func(client Client) Client {
+		return Retrying(client, baseWait, maxWait, maxRetries, opts...)
+	}
+}
+
+// WithRateLimiter is the Middleware version of RateLimiting.
+func WithRateLimiter(limiter Limiter) Middleware {
+	return func(client Client) Client {
+		return RateLimiting(client, limiter)
+	}
+}
+
+// Handler sends a request, usually by passing it to the next client in a
+// chain.
+type Handler func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error)
+
+// Interceptor is a function that runs around every request. It can inspect
+// and modify the request before passing it to next, and the response (or
+// error) after. It can also skip next, for example to answer the request
+// itself.
+type Interceptor func(ctx context.Context, req ChatCompletionRequest, next Handler) (ChatCompletionResponse, error)
+
+type interceptingClient struct {
+	client      Client
+	interceptor Interceptor
+}
+
+// Intercept returns a Middleware that runs interceptor around every request,
+// which is a simple way to add things like logging or redaction without
+// writing a client wrapper. Requests with Stream set are intercepted as
+// usual, but interceptor can't run on streams made with
+// CreateChatCompletionStream, as it couldn't see the response. So that they
+// don't bypass it, the returned client only supports them if Intercept is
+// next to an InterceptStream in the chain, which handles them instead;
+// otherwise they fail with ErrStreamingNotSupported.
+func Intercept(interceptor Interceptor) Middleware {
+	return func(client Client) Client {
+		intercepting := &interceptingClient{
+			client:      client,
+			interceptor: interceptor,
+		}
+		if _, ok := client.(*streamInterceptingClient); ok {
+			return streamsInterceptedClient{intercepting}
+		}
+		return intercepting
+	}
+}
+
+func (client *interceptingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	return client.interceptor(ctx, req, client.client.CreateChatCompletion)
+}
+
+// streamsInterceptedClient is an interceptingClient that wraps an
+// InterceptStream, which handles the streams.
+type streamsInterceptedClient struct {
+	*interceptingClient
+}
+
+// CreateChatCompletionStream implements StreamingClient.
+func (client streamsInterceptedClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	return client.client.(*streamInterceptingClient).CreateChatCompletionStream(ctx, req)
+}
+
+// Unwrap implements Wrapper.
+func (client *interceptingClient) Unwrap() Client {
+	return client.client
+}
+
+// StreamHandler opens a stream, usually by passing the request to the next
+// client in a chain.
+type StreamHandler func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error)
+
+// StreamInterceptor is like Interceptor, for CreateChatCompletionStream. It
+// can wrap the stream returned by next to see or modify the events.
+type StreamInterceptor func(ctx context.Context, req ChatCompletionRequest, next StreamHandler) (ChatCompletionStream, error)
+
+type streamInterceptingClient struct {
+	client      Client
+	interceptor StreamInterceptor
+}
+
+// InterceptStream returns a Middleware that runs interceptor around every
+// call to CreateChatCompletionStream. Other requests are passed to the
+// wrapped client unchanged, so it is usually combined with Intercept, right
+// before or after it in the chain.
+func InterceptStream(interceptor StreamInterceptor) Middleware {
+	return func(client Client) Client {
+		return &streamInterceptingClient{
+			client:      client,
+			interceptor: interceptor,
+		}
+	}
+}
+
+func (client *streamInterceptingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	return client.client.CreateChatCompletion(ctx, req)
+}
+
+// CreateChatCompletionStream implements StreamingClient.
+func (client *streamInterceptingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	next := client.client
+	if intercepting, ok := next.(*interceptingClient); ok {
+		// The Intercept right below doesn't support streams, and this
+		// interceptor handles them instead.
+		next = intercepting.client
+	}
+	streaming, ok := next.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	return client.interceptor(ctx, req, streaming.CreateChatCompletionStream)
+}
+
+// Unwrap implements Wrapper.
+func (client *streamInterceptingClient) Unwrap() Client {
+	return client.client
+}
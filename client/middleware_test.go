@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ryszard/agency/util/cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	recording := func(name string) Middleware {
+		return Intercept(func(ctx context.Context, req ChatCompletionRequest, next Handler) (ChatCompletionResponse, error) {
+			order = append(order, name)
+			return next(ctx, req)
+		})
+	}
+
+	cl := Chain(answering("base"), recording("a"), recording("b"), recording("c"))
+	_, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, order)
+}
+
+func TestIntercept(t *testing.T) {
+	redact := Intercept(func(ctx context.Context, req ChatCompletionRequest, next Handler) (ChatCompletionResponse, error) {
+		req.Model = "redacted"
+		resp, err := next(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+		resp.SetMetadata("intercepted", "yes")
+		return resp, nil
+	})
+
+	cl := Chain(answering("base"), redact)
+	resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, "base:redacted", resp.Choices[0].Content)
+	assert.Equal(t, "yes", resp.Metadata["intercepted"])
+}
+
+func TestInterceptStreams(t *testing.T) {
+	base := streamingAnswering{funcClient: answering("base"), content: "one two"}
+	var models []string
+	passthrough := Intercept(func(ctx context.Context, req ChatCompletionRequest, next Handler) (ChatCompletionResponse, error) {
+		return next(ctx, req)
+	})
+	recordModel := InterceptStream(func(ctx context.Context, req ChatCompletionRequest, next StreamHandler) (ChatCompletionStream, error) {
+		models = append(models, req.Model)
+		return next(ctx, req)
+	})
+
+	// InterceptStream can go before or after Intercept.
+	for _, cl := range []Client{Chain(base, passthrough, recordModel), Chain(base, recordModel, passthrough)} {
+		streaming, ok := cl.(StreamingClient)
+		assert.True(t, ok)
+		stream, err := streaming.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{Model: "m"})
+		assert.NoError(t, err)
+		resp, err := CollectStream(stream, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "one two", resp.Choices[0].Content)
+	}
+	assert.Equal(t, []string{"m", "m"}, models)
+
+	// Without a streaming client underneath, there's nothing to intercept.
+	_, err := Chain(answering("base"), Intercept(nil), recordModel).(StreamingClient).CreateChatCompletionStream(context.Background(), ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrStreamingNotSupported)
+}
+
+func TestInterceptDoesNotLetStreamsBypassIt(t *testing.T) {
+	base := streamingAnswering{funcClient: answering("base"), content: "secret"}
+	redact := Intercept(func(ctx context.Context, req ChatCompletionRequest, next Handler) (ChatCompletionResponse, error) {
+		req.Messages = nil
+		return next(ctx, req)
+	})
+
+	// Streams couldn't be redacted, so they are not supported, also by the
+	// wrappers around Intercept.
+	_, ok := Chain(base, redact).(StreamingClient)
+	assert.False(t, ok)
+	cl := Chain(base, WithRetries(time.Millisecond, time.Millisecond, 1), redact)
+	_, err := cl.(StreamingClient).CreateChatCompletionStream(context.Background(), ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrStreamingNotSupported)
+}
+
+func TestChainWithBuiltinMiddlewares(t *testing.T) {
+	calls := 0
+	flaky := funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		calls++
+		if calls == 1 {
+			return ChatCompletionResponse{}, Retryable(errors.New("overloaded"))
+		}
+		return answering("flaky")(ctx, req)
+	})
+	cl := Chain(flaky,
+		WithCache(cache.Memory()),
+		WithRetries(time.Millisecond, time.Millisecond, 3),
+		WithRateLimiter(NewAdaptiveLimiter(0.1)),
+	)
+
+	for i := 0; i < 2; i++ {
+		resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+		assert.NoError(t, err)
+		assert.Equal(t, "flaky:m", resp.Choices[0].Content)
+	}
+	// One failure, one success, and then a cache hit.
+	assert.Equal(t, 2, calls)
+}
@@ -2,10 +2,14 @@ package openai
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"math"
+	"net/http"
+	"reflect"
+	"time"
 
 	"github.com/ryszard/agency/client"
 	"github.com/sashabaranov/go-openai"
@@ -23,107 +27,303 @@ const (
 	GPT3Dot5Turbo           = "gpt-3.5-turbo"
 )
 
+// Prices are the prices of the models, for use with client.Budgeted.
+var Prices = map[string]client.Price{
+	string(GPT432K0314): {Prompt: 0.06, Completion: 0.12},
+	string(GPT432K):     {Prompt: 0.06, Completion: 0.12},
+	string(GPT40314):    {Prompt: 0.03, Completion: 0.06},
+	GPT4:                {Prompt: 0.03, Completion: 0.06},
+	GPT3Dot5Turbo0301:   {Prompt: 0.0015, Completion: 0.002},
+	GPT3Dot5Turbo:       {Prompt: 0.0005, Completion: 0.0015},
+}
+
 type Client struct {
 	client *openai.Client
 }
 
 func New(apiKey string) *Client {
-	return &Client{
-		client: openai.NewClient(apiKey),
-	}
+	return NewWithConfig(openai.DefaultConfig(apiKey))
 }
 
+// NewClient returns a client using cl. Unlike the clients returned by New and
+// NewWithConfig, it cannot read the headers of error responses, so its rate
+// limit errors don't say how long to wait.
 func NewClient(cl *openai.Client) *Client {
 	return &Client{
 		client: cl,
 	}
 }
 
+// NewWithConfig returns a client using the given configuration. The
+// transport of config.HTTPClient is wrapped to read response headers.
+func NewWithConfig(config openai.ClientConfig) *Client {
+	var httpClient http.Client
+	if config.HTTPClient != nil {
+		httpClient = *config.HTTPClient
+	}
+	httpClient.Transport = headerRecorder{next: httpClient.Transport}
+	config.HTTPClient = &httpClient
+	return &Client{
+		client: openai.NewClientWithConfig(config),
+	}
+}
+
+type headersKey struct{}
+
+// recordHeaders returns a context that makes headerRecorder store the headers
+// of the response in the returned header. The go-openai package drops the
+// headers of error responses, so this is the only way to get them.
+func recordHeaders(ctx context.Context) (context.Context, *http.Header) {
+	header := new(http.Header)
+	return context.WithValue(ctx, headersKey{}, header), header
+}
+
+// headerRecorder is an http.RoundTripper that stores the response headers for
+// requests made with a context returned by recordHeaders.
+type headerRecorder struct {
+	next http.RoundTripper
+}
+
+func (t headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+	if header, ok := req.Context().Value(headersKey{}).(*http.Header); ok && err == nil {
+		*header = resp.Header.Clone()
+	}
+	return resp, err
+}
+
+// ContextSizes are the sizes of the context windows of the models, in tokens.
+var ContextSizes = map[string]int{
+	string(GPT432K0314): 32768,
+	string(GPT432K):     32768,
+	string(GPT40314):    8192,
+	GPT4:                8192,
+	GPT3Dot5Turbo0301:   4096,
+	GPT3Dot5Turbo:       16385,
+}
+
+// customParams are the CustomParams understood by TranslateRequest.
+var customParams = map[string]reflect.Type{
+	"top_p":             reflect.TypeOf(float32(0)),
+	"presence_penalty":  reflect.TypeOf(float32(0)),
+	"frequency_penalty": reflect.TypeOf(float32(0)),
+	"stop":              reflect.TypeOf([]string{}),
+	"logit_bias":        reflect.TypeOf(map[string]int{}),
+	"n":                 reflect.TypeOf(0),
+	"user":              reflect.TypeOf(""),
+}
+
 func (Client) SupportsStreaming() bool {
 	return true
 }
 
-var _ client.Client = (*Client)(nil)
+func (Client) SupportsTools() bool {
+	return true
+}
+
+func (Client) SupportsImages() bool {
+	return true
+}
 
-func maybeWrapError(err error) error {
-	e := &openai.APIError{}
-	if errors.As(err, &e) && e.HTTPStatusCode == 429 || e.HTTPStatusCode == 500 {
-		return client.Retryable(err)
+func (Client) SupportedParameters() map[string]reflect.Type {
+	return customParams
+}
+
+func (Client) MaxContextTokens(model string) (int, bool) {
+	tokens, ok := ContextSizes[model]
+	return tokens, ok
+}
+
+var _ client.Capabilities = (*Client)(nil)
+
+var _ client.StreamingClient = (*Client)(nil)
+
+// maybeWrapError wraps errors that can be retried. header is the header of
+// the response, if known, and is used to find out how long to wait.
+func maybeWrapError(err error, header http.Header) error {
+	apiErr := &openai.APIError{}
+	reqErr := &openai.RequestError{}
+	var code int
+	switch {
+	case errors.As(err, &apiErr):
+		code = apiErr.HTTPStatusCode
+	case errors.As(err, &reqErr):
+		code = reqErr.HTTPStatusCode
+	}
+	switch {
+	case code == 429:
+		return client.RateLimitedAfter(err, retryAfter(header))
+	case code >= 500:
+		return client.RetryableAfter(err, client.ParseRetryAfter(header))
 	}
 	return err
 
 }
 
+// retryAfter returns how long to wait after a rate limit error. If there's
+// no Retry-After header, it uses the reset time of the exhausted limit.
+func retryAfter(header http.Header) time.Duration {
+	if wait := client.ParseRetryAfter(header); wait > 0 {
+		return wait
+	}
+	var wait time.Duration
+	for _, limit := range []string{"requests", "tokens"} {
+		if header.Get("X-Ratelimit-Remaining-"+limit) != "0" {
+			continue
+		}
+		if reset, err := time.ParseDuration(header.Get("X-Ratelimit-Reset-" + limit)); err == nil && reset > wait {
+			wait = reset
+		}
+	}
+	return wait
+}
+
 func (cl *Client) CreateChatCompletion(ctx context.Context, request client.ChatCompletionRequest) (client.ChatCompletionResponse, error) {
+	if request.WantsStreaming() {
+		stream, err := cl.CreateChatCompletionStream(ctx, request)
+		if err != nil {
+			return client.ChatCompletionResponse{}, err
+		}
+		resp, err := client.CollectStream(stream, request.Stream)
+		if err != nil {
+			return client.ChatCompletionResponse{}, err
+		}
+		request.Stream.Write([]byte("\n\n"))
+		return resp, nil
+	}
 	req, err := TranslateRequest(request)
 	if err != nil {
 		return client.ChatCompletionResponse{}, err
 	}
-	if request.WantsStreaming() {
-		return cl.createChatCompletionStream(ctx, req, request.Stream)
-	}
+	ctx, header := recordHeaders(ctx)
 	resp, err := cl.client.CreateChatCompletion(ctx, req)
 	if err != nil {
-		return client.ChatCompletionResponse{}, maybeWrapError(err)
+		return client.ChatCompletionResponse{}, maybeWrapError(err, *header)
 	}
 	return TranslateResponse(resp), nil
 }
 
-func (cl *Client) createChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest, w io.Writer) (client.ChatCompletionResponse, error) {
+// CreateChatCompletionStream implements client.StreamingClient. Note that the
+// streaming API doesn't report token usage.
+func (cl *Client) CreateChatCompletionStream(ctx context.Context, request client.ChatCompletionRequest) (client.ChatCompletionStream, error) {
+	req, err := TranslateRequest(request)
+	if err != nil {
+		return nil, err
+	}
 	req.Stream = true
 
 	log.WithFields(log.Fields{
 		"request": fmt.Sprintf("%+v", req),
 		"stream":  true,
-	}).Debug("RespondStream: Sending request")
+	}).Debug("CreateChatCompletionStream: Sending request")
+	ctx, header := recordHeaders(ctx)
 	stream, err := cl.client.CreateChatCompletionStream(ctx, req)
 	if err != nil {
-		return client.ChatCompletionResponse{}, err
+		return nil, maybeWrapError(err, *header)
 	}
+	return &chatCompletionStream{
+		stream:    stream,
+		rateLimit: TranslateRateLimitHeaders(stream.GetRateLimitHeaders()),
+	}, nil
+}
 
-	defer stream.Close()
-
-	var b strings.Builder
+type chatCompletionStream struct {
+	stream *openai.ChatCompletionStream
+	// rateLimit is sent with the first event.
+	rateLimit *client.RateLimit
+}
 
+func (s *chatCompletionStream) Recv() (client.StreamEvent, error) {
 	for {
-		r, err := stream.Recv()
+		r, err := s.stream.Recv()
 		if errors.Is(err, io.EOF) {
-			break
+			return client.StreamEvent{}, io.EOF
 		} else if err != nil {
-			return client.ChatCompletionResponse{}, err
+			return client.StreamEvent{}, maybeWrapError(err, nil)
 		}
-		//logger.WithField("stream response", fmt.Sprintf("%+v", r)).Trace("Received response from OpenAI API")
-		delta := r.Choices[0].Delta.Content
-		if _, err := b.WriteString(delta); err != nil {
-			return client.ChatCompletionResponse{}, err
+		if len(r.Choices) == 0 {
+			continue
 		}
-		if _, err := w.Write([]byte(delta)); err != nil {
-			return client.ChatCompletionResponse{}, err
+		choice := r.Choices[0]
+		event := client.StreamEvent{
+			Content:      choice.Delta.Content,
+			ToolCalls:    TranslateToolCallDeltas(choice.Delta.ToolCalls),
+			FinishReason: TranslateFinishReason(choice.FinishReason),
+			RateLimit:    s.rateLimit,
 		}
-
+		s.rateLimit = nil
+		return event, nil
 	}
-	w.Write([]byte("\n\n"))
+}
 
-	message := client.Message{
-		Content: b.String(),
-		Role:    client.Assistant,
-	}
+func (s *chatCompletionStream) Close() error {
+	return s.stream.Close()
+}
 
-	return client.ChatCompletionResponse{Choices: []client.Message{message}}, nil
+// TranslateToolCallDeltas translates the tool call fragments from a streaming
+// response of the openai package to ones from the client package.
+func TranslateToolCallDeltas(deltas []openai.ToolCall) []client.ToolCallDelta {
+	if len(deltas) == 0 {
+		return nil
+	}
+	clientDeltas := make([]client.ToolCallDelta, len(deltas))
+	for i, delta := range deltas {
+		index := i
+		if delta.Index != nil {
+			index = *delta.Index
+		}
+		clientDeltas[i] = client.ToolCallDelta{
+			Index:     index,
+			ID:        delta.ID,
+			Name:      delta.Function.Name,
+			Arguments: delta.Function.Arguments,
+		}
+	}
+	return clientDeltas
 }
 
 var roleMapping = map[client.Role]string{
 	client.User:      openai.ChatMessageRoleUser,
 	client.System:    openai.ChatMessageRoleSystem,
 	client.Assistant: openai.ChatMessageRoleAssistant,
+	client.Tool:      openai.ChatMessageRoleTool,
 }
 
 func TranslateRequest(clientReq client.ChatCompletionRequest) (openai.ChatCompletionRequest, error) {
 	req := openai.ChatCompletionRequest{
-		Model:       clientReq.Model,
-		Messages:    []openai.ChatCompletionMessage{},
-		MaxTokens:   clientReq.MaxTokens,
-		Temperature: clientReq.Temperature,
+		Model:     clientReq.Model,
+		Messages:  []openai.ChatCompletionMessage{},
+		MaxTokens: clientReq.MaxTokens,
+		Stop:      clientReq.Stop,
+		Seed:      clientReq.Seed,
+		N:         clientReq.N,
+		User:      clientReq.User,
+	}
+
+	if clientReq.Temperature != nil {
+		req.Temperature = *clientReq.Temperature
+		if req.Temperature == 0 {
+			// go-openai omits a temperature of 0, which would make it the
+			// default of 1, so the smallest one above 0 is sent instead.
+			req.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+
+	if clientReq.TopK != nil {
+		return openai.ChatCompletionRequest{}, fmt.Errorf("top_k is not supported by openai")
+	}
+	if clientReq.TopP != nil {
+		req.TopP = *clientReq.TopP
+	}
+	if clientReq.PresencePenalty != nil {
+		req.PresencePenalty = *clientReq.PresencePenalty
+	}
+	if clientReq.FrequencyPenalty != nil {
+		req.FrequencyPenalty = *clientReq.FrequencyPenalty
 	}
 
 	if topP, ok := clientReq.CustomParams["top_p"]; ok {
@@ -148,7 +348,10 @@ func TranslateRequest(clientReq client.ChatCompletionRequest) (openai.ChatComple
 	}
 
 	if stop, ok := clientReq.CustomParams["stop"]; ok {
-		req.Stop = stop.([]string)
+		req.Stop, ok = stop.([]string)
+		if !ok {
+			return openai.ChatCompletionRequest{}, fmt.Errorf("stop must be a []string")
+		}
 	}
 
 	if logitBias, ok := clientReq.CustomParams["logit_bias"]; ok {
@@ -159,42 +362,223 @@ func TranslateRequest(clientReq client.ChatCompletionRequest) (openai.ChatComple
 		req.LogitBias = logitBiasMap
 	}
 
-	// FIXME(ryszrd): rethink how should I handle n.
 	if n, ok := clientReq.CustomParams["n"]; ok {
-		req.N = n.(int)
+		req.N, ok = n.(int)
+		if !ok {
+			return openai.ChatCompletionRequest{}, fmt.Errorf("n must be an int")
+		}
 	}
 
 	if user, ok := clientReq.CustomParams["user"]; ok {
-		req.User = user.(string)
+		req.User, ok = user.(string)
+		if !ok {
+			return openai.ChatCompletionRequest{}, fmt.Errorf("user must be a string")
+		}
 	}
 
 	for _, message := range clientReq.Messages {
-		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
-			Content: message.Content,
-			Role:    roleMapping[message.Role],
+		msg := openai.ChatCompletionMessage{
+			Content:    message.Content,
+			Role:       roleMapping[message.Role],
+			ToolCalls:  translateToolCalls(message.ToolCalls),
+			ToolCallID: message.ToolCallID,
+		}
+		if len(message.Parts) > 0 {
+			parts, err := TranslateContentParts(message)
+			if err != nil {
+				return openai.ChatCompletionRequest{}, err
+			}
+			msg.Content = ""
+			msg.MultiContent = parts
+		}
+		req.Messages = append(req.Messages, msg)
+	}
+
+	for _, tool := range clientReq.Tools {
+		req.Tools = append(req.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
 		})
 	}
 
+	switch clientReq.ToolChoice {
+	case "":
+	case client.ToolChoiceAuto, client.ToolChoiceNone:
+		req.ToolChoice = string(clientReq.ToolChoice)
+	default:
+		req.ToolChoice = openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: string(clientReq.ToolChoice)},
+		}
+	}
+
 	return req, nil
 
 }
 
+// TranslateContentParts translates the content of a message with parts to
+// the multi content parts of the openai package.
+func TranslateContentParts(message client.Message) ([]openai.ChatMessagePart, error) {
+	parts := make([]openai.ChatMessagePart, 0, len(message.Parts)+1)
+	if message.Content != "" {
+		parts = append(parts, openai.ChatMessagePart{
+			Type: openai.ChatMessagePartTypeText,
+			Text: message.Content,
+		})
+	}
+	for _, part := range message.Parts {
+		switch part.Type {
+		case client.ContentPartText:
+			parts = append(parts, openai.ChatMessagePart{
+				Type: openai.ChatMessagePartTypeText,
+				Text: part.Text,
+			})
+		case client.ContentPartImageURL:
+			parts = append(parts, openai.ChatMessagePart{
+				Type:     openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{URL: part.URL},
+			})
+		case client.ContentPartImageData:
+			if part.MIMEType == "" {
+				return nil, fmt.Errorf("image data part must have a MIME type")
+			}
+			url := fmt.Sprintf("data:%s;base64,%s", part.MIMEType, base64.StdEncoding.EncodeToString(part.Data))
+			parts = append(parts, openai.ChatMessagePart{
+				Type:     openai.ChatMessagePartTypeImageURL,
+				ImageURL: &openai.ChatMessageImageURL{URL: url},
+			})
+		default:
+			return nil, fmt.Errorf("unsupported content part type: %q", part.Type)
+		}
+	}
+	return parts, nil
+}
+
 // TranslateResponse translates a ChatCompletionResponse from the openai package to one from the client package
 func TranslateResponse(openaiResp openai.ChatCompletionResponse) client.ChatCompletionResponse {
-	// Create a new slice to hold the translated messages
-	clientMessages := make([]client.Message, len(openaiResp.Choices))
+	// Create a new slice to hold the translated choices
+	choices := make([]client.Choice, len(openaiResp.Choices))
 
 	// Loop over the choices in the openai response
 	for i, choice := range openaiResp.Choices {
 		// Translate each choice's message to the client's Message type
-		clientMessages[i] = client.Message{
-			Content: choice.Message.Content,
-			Role:    client.Role(choice.Message.Role),
+		choices[i] = client.Choice{
+			Message: client.Message{
+				Content:    choice.Message.Content,
+				Role:       client.Role(choice.Message.Role),
+				ToolCalls:  TranslateToolCalls(choice.Message.ToolCalls),
+				ToolCallID: choice.Message.ToolCallID,
+			},
+			FinishReason: TranslateFinishReason(choice.FinishReason),
 		}
 	}
 
-	// Return a new ChatCompletionResponse from the client package, using the translated messages
+	// Return a new ChatCompletionResponse from the client package, using the translated choices
 	return client.ChatCompletionResponse{
-		Choices: clientMessages,
+		Choices: choices,
+		Usage: client.Usage{
+			PromptTokens:     openaiResp.Usage.PromptTokens,
+			CompletionTokens: openaiResp.Usage.CompletionTokens,
+			TotalTokens:      openaiResp.Usage.TotalTokens,
+		},
+		RateLimit: TranslateRateLimitHeaders(openaiResp.GetRateLimitHeaders()),
+	}
+}
+
+// TranslateRateLimitHeaders translates the rate limit headers of a response to
+// a client.RateLimit. It returns nil if the response had no such headers.
+func TranslateRateLimitHeaders(headers openai.RateLimitHeaders) *client.RateLimit {
+	if headers.LimitRequests == 0 && headers.LimitTokens == 0 {
+		return nil
+	}
+	return &client.RateLimit{
+		LimitRequests:     headers.LimitRequests,
+		RemainingRequests: headers.RemainingRequests,
+		ResetRequests:     headers.ResetRequests.Time(),
+		LimitTokens:       headers.LimitTokens,
+		RemainingTokens:   headers.RemainingTokens,
+		ResetTokens:       headers.ResetTokens.Time(),
+	}
+}
+
+// TranslateFinishReason translates a FinishReason from the openai package to
+// one from the client package.
+func TranslateFinishReason(reason openai.FinishReason) client.FinishReason {
+	switch reason {
+	case openai.FinishReasonStop:
+		return client.FinishReasonStop
+	case openai.FinishReasonLength:
+		return client.FinishReasonLength
+	case openai.FinishReasonToolCalls, openai.FinishReasonFunctionCall:
+		return client.FinishReasonToolCalls
+	case openai.FinishReasonContentFilter:
+		return client.FinishReasonContentFilter
+	default:
+		return ""
+	}
+}
+
+func translateToolCalls(calls []client.ToolCall) []openai.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	openaiCalls := make([]openai.ToolCall, len(calls))
+	for i, call := range calls {
+		openaiCalls[i] = openai.ToolCall{
+			ID:   call.ID,
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      call.Name,
+				Arguments: call.Arguments,
+			},
+		}
+	}
+	return openaiCalls
+}
+
+// TranslateToolCalls translates tool calls from the openai package to ones
+// from the client package.
+func TranslateToolCalls(openaiCalls []openai.ToolCall) []client.ToolCall {
+	if len(openaiCalls) == 0 {
+		return nil
+	}
+	calls := make([]client.ToolCall, len(openaiCalls))
+	for i, call := range openaiCalls {
+		calls[i] = client.ToolCall{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		}
+	}
+	return calls
+}
+
+var _ client.EmbeddingClient = (*Client)(nil)
+
+// CreateEmbeddings implements client.EmbeddingClient.
+func (cl *Client) CreateEmbeddings(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	ctx, header := recordHeaders(ctx)
+	resp, err := cl.client.CreateEmbeddings(ctx, openai.EmbeddingRequest{
+		Input: inputs,
+		Model: openai.EmbeddingModel(model),
+	})
+	if err != nil {
+		return nil, maybeWrapError(err, *header)
+	}
+	if len(resp.Data) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(resp.Data))
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	for _, data := range resp.Data {
+		if data.Index < 0 || data.Index >= len(inputs) {
+			return nil, fmt.Errorf("embedding index out of range: %d", data.Index)
+		}
+		embeddings[data.Index] = data.Embedding
 	}
+	return embeddings, nil
 }
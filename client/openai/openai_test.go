@@ -1,7 +1,12 @@
 package openai
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/ryszard/agency/client"
 	"github.com/sashabaranov/go-openai"
@@ -26,17 +31,27 @@ func TestTranslateResponse(t *testing.T) {
 			},
 		},
 		Usage: openai.Usage{
-			// Fill in with appropriate data
+			PromptTokens:     10,
+			CompletionTokens: 8,
+			TotalTokens:      18,
 		},
 	}
 
 	expectedClientResponse := client.ChatCompletionResponse{
-		Choices: []client.Message{
+		Choices: []client.Choice{
 			{
-				Content: "Hello, how can I assist you today?",
-				Role:    "assistant",
+				Message: client.Message{
+					Content: "Hello, how can I assist you today?",
+					Role:    "assistant",
+				},
+				FinishReason: client.FinishReasonStop,
 			},
 		},
+		Usage: client.Usage{
+			PromptTokens:     10,
+			CompletionTokens: 8,
+			TotalTokens:      18,
+		},
 	}
 
 	actualClientResponse := TranslateResponse(openaiResponse)
@@ -52,15 +67,23 @@ func TestTranslateResponse(t *testing.T) {
 		if actualClientResponse.Choices[i].Role != expectedClientResponse.Choices[i].Role {
 			t.Errorf("Expected role '%s', but got '%s'", expectedClientResponse.Choices[i].Role, actualClientResponse.Choices[i].Role)
 		}
+		if actualClientResponse.Choices[i].FinishReason != expectedClientResponse.Choices[i].FinishReason {
+			t.Errorf("Expected finish reason '%s', but got '%s'", expectedClientResponse.Choices[i].FinishReason, actualClientResponse.Choices[i].FinishReason)
+		}
+	}
+
+	if actualClientResponse.Usage != expectedClientResponse.Usage {
+		t.Errorf("Expected usage %+v, but got %+v", expectedClientResponse.Usage, actualClientResponse.Usage)
 	}
 }
 
 func TestTranslateRequest(t *testing.T) {
 	// Setup
+	temperature := float32(0.8)
 	clientReq := client.ChatCompletionRequest{
 		Model:       "gpt-4",
 		MaxTokens:   100,
-		Temperature: 0.8,
+		Temperature: &temperature,
 		Messages: []client.Message{
 			{
 				Content: "you are an assistant",
@@ -111,3 +134,287 @@ func TestTranslateRequest(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, res)
 }
+
+func TestTranslateRequestTools(t *testing.T) {
+	params := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"code": map[string]any{"type": "string"},
+		},
+	}
+	clientReq := client.ChatCompletionRequest{
+		Model: "gpt-4",
+		Messages: []client.Message{
+			{Content: "What's the Python version?", Role: client.User},
+			{
+				Role:      client.Assistant,
+				ToolCalls: []client.ToolCall{{ID: "call_1", Name: "python", Arguments: `{"code":"import sys; sys.version"}`}},
+			},
+			{Content: "3.11.2", Role: client.Tool, ToolCallID: "call_1"},
+		},
+		Tools: []client.ToolDefinition{
+			{Name: "python", Description: "Runs Python code.", Parameters: params},
+		},
+		ToolChoice: "python",
+	}
+
+	expected := openai.ChatCompletionRequest{
+		Model: "gpt-4",
+		Messages: []openai.ChatCompletionMessage{
+			{Content: "What's the Python version?", Role: openai.ChatMessageRoleUser},
+			{
+				Role: openai.ChatMessageRoleAssistant,
+				ToolCalls: []openai.ToolCall{{
+					ID:       "call_1",
+					Type:     openai.ToolTypeFunction,
+					Function: openai.FunctionCall{Name: "python", Arguments: `{"code":"import sys; sys.version"}`},
+				}},
+			},
+			{Content: "3.11.2", Role: openai.ChatMessageRoleTool, ToolCallID: "call_1"},
+		},
+		Tools: []openai.Tool{{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        "python",
+				Description: "Runs Python code.",
+				Parameters:  params,
+			},
+		}},
+		ToolChoice: openai.ToolChoice{
+			Type:     openai.ToolTypeFunction,
+			Function: openai.ToolFunction{Name: "python"},
+		},
+	}
+
+	res, err := TranslateRequest(clientReq)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, res)
+
+	clientReq.ToolChoice = client.ToolChoiceAuto
+	res, err = TranslateRequest(clientReq)
+	assert.NoError(t, err)
+	assert.Equal(t, "auto", res.ToolChoice)
+}
+
+func TestTranslateResponseToolCalls(t *testing.T) {
+	openaiResponse := openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{
+			{
+				Message: openai.ChatCompletionMessage{
+					Role: openai.ChatMessageRoleAssistant,
+					ToolCalls: []openai.ToolCall{{
+						ID:       "call_1",
+						Type:     openai.ToolTypeFunction,
+						Function: openai.FunctionCall{Name: "bash", Arguments: `{"script":"ls"}`},
+					}},
+				},
+				FinishReason: openai.FinishReasonToolCalls,
+			},
+		},
+	}
+
+	resp := TranslateResponse(openaiResponse)
+	assert.Equal(t, []client.ToolCall{{ID: "call_1", Name: "bash", Arguments: `{"script":"ls"}`}}, resp.Choices[0].ToolCalls)
+}
+
+func TestTranslateToolCallDeltas(t *testing.T) {
+	zero, one := 0, 1
+	deltas := []openai.ToolCall{
+		{Index: &zero, Function: openai.FunctionCall{Arguments: `"ls"}`}},
+		{Index: &one, ID: "call_2", Function: openai.FunctionCall{Name: "python", Arguments: `{}`}},
+	}
+
+	assert.Equal(t, []client.ToolCallDelta{
+		{Index: 0, Arguments: `"ls"}`},
+		{Index: 1, ID: "call_2", Name: "python", Arguments: `{}`},
+	}, TranslateToolCallDeltas(deltas))
+}
+
+func TestTranslateRequestContentParts(t *testing.T) {
+	clientReq := client.ChatCompletionRequest{
+		Model: "gpt-4-vision-preview",
+		Messages: []client.Message{
+			{
+				Content: "What's in these images?",
+				Role:    client.User,
+				Parts: []client.ContentPart{
+					client.ImageURLPart("https://example.com/cat.png"),
+					client.ImageDataPart("image/png", []byte("png")),
+				},
+			},
+		},
+	}
+
+	res, err := TranslateRequest(clientReq)
+	assert.NoError(t, err)
+	assert.Equal(t, []openai.ChatCompletionMessage{
+		{
+			Role: openai.ChatMessageRoleUser,
+			MultiContent: []openai.ChatMessagePart{
+				{Type: openai.ChatMessagePartTypeText, Text: "What's in these images?"},
+				{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/cat.png"}},
+				{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/png;base64,cG5n"}},
+			},
+		},
+	}, res.Messages)
+
+	clientReq.Messages[0].Parts = []client.ContentPart{{Type: client.ContentPartImageData, Data: []byte("png")}}
+	_, err = TranslateRequest(clientReq)
+	assert.Error(t, err, "image data without a MIME type should be rejected")
+}
+
+func TestTranslateRequestSamplingParams(t *testing.T) {
+	topP, presencePenalty, frequencyPenalty := float32(0.9), float32(0.6), float32(0.5)
+	seed := 42
+	clientReq := client.ChatCompletionRequest{
+		Model:            "gpt-4",
+		TopP:             &topP,
+		Stop:             []string{"\n"},
+		Seed:             &seed,
+		PresencePenalty:  &presencePenalty,
+		FrequencyPenalty: &frequencyPenalty,
+		N:                2,
+		User:             "user123",
+	}
+
+	expected := openai.ChatCompletionRequest{
+		Model:            "gpt-4",
+		Messages:         []openai.ChatCompletionMessage{},
+		TopP:             0.9,
+		Stop:             []string{"\n"},
+		Seed:             &seed,
+		PresencePenalty:  0.6,
+		FrequencyPenalty: 0.5,
+		N:                2,
+		User:             "user123",
+	}
+
+	res, err := TranslateRequest(clientReq)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, res)
+
+	topK := 10
+	clientReq.TopK = &topK
+	_, err = TranslateRequest(clientReq)
+	assert.Error(t, err, "top_k is not supported")
+}
+
+func TestTranslateRequestInvalidCustomParams(t *testing.T) {
+	for _, params := range []map[string]interface{}{
+		{"stop": "\n"},
+		{"n": 2.0},
+		{"user": 123},
+	} {
+		_, err := TranslateRequest(client.ChatCompletionRequest{Model: "gpt-4", CustomParams: params})
+		assert.Error(t, err, "%v", params)
+	}
+}
+
+func TestCreateEmbeddings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openai.EmbeddingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		assert.Equal(t, openai.EmbeddingModel("text-embedding-3-small"), req.Model)
+		// Return the embeddings out of order, to check that they are sorted
+		// by index.
+		json.NewEncoder(w).Encode(openai.EmbeddingResponse{
+			Data: []openai.Embedding{
+				{Index: 1, Embedding: []float32{0, 1}},
+				{Index: 0, Embedding: []float32{1, 0}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	config := openai.DefaultConfig("token")
+	config.BaseURL = server.URL
+	cl := NewClient(openai.NewClientWithConfig(config))
+
+	embeddings, err := cl.CreateEmbeddings(context.Background(), "text-embedding-3-small", []string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float32{{1, 0}, {0, 1}}, embeddings)
+}
+
+func TestRateLimitErrorRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ratelimit-Remaining-Requests", "10")
+		w.Header().Set("X-Ratelimit-Reset-Requests", "1s")
+		w.Header().Set("X-Ratelimit-Remaining-Tokens", "0")
+		w.Header().Set("X-Ratelimit-Reset-Tokens", "6m0s")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"message": "Rate limit reached", "type": "tokens"}}`))
+	}))
+	defer server.Close()
+
+	config := openai.DefaultConfig("token")
+	config.BaseURL = server.URL
+	cl := NewWithConfig(config)
+
+	_, err := cl.CreateChatCompletion(context.Background(), client.ChatCompletionRequest{
+		Model:    GPT4,
+		Messages: []client.Message{{Role: client.User, Content: "Hi"}},
+	})
+	assert.True(t, client.IsRateLimited(err))
+	var rerr *client.RetryableError
+	assert.ErrorAs(t, err, &rerr)
+	assert.Equal(t, 6*time.Minute, rerr.RetryAfter())
+}
+
+func TestAdaptiveRateLimiting(t *testing.T) {
+	remaining := "0"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Ratelimit-Limit-Requests", "100")
+		w.Header().Set("X-Ratelimit-Remaining-Requests", remaining)
+		w.Header().Set("X-Ratelimit-Reset-Requests", "100ms")
+		json.NewEncoder(w).Encode(openai.ChatCompletionResponse{
+			Choices: []openai.ChatCompletionChoice{{Message: openai.ChatCompletionMessage{Role: "assistant", Content: "Hi"}}},
+		})
+	}))
+	defer server.Close()
+
+	config := openai.DefaultConfig("token")
+	config.BaseURL = server.URL
+	cl := client.AdaptiveRateLimiting(NewWithConfig(config), client.NewAdaptiveLimiter(0.2))
+	req := client.ChatCompletionRequest{
+		Model:    GPT4,
+		Messages: []client.Message{{Role: client.User, Content: "Hi"}},
+	}
+
+	resp, err := cl.CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, resp.RateLimit.LimitRequests)
+	assert.Equal(t, 0, resp.RateLimit.RemainingRequests)
+
+	// No requests are left, so the next one waits for the reset.
+	remaining = "100"
+	start := time.Now()
+	_, err = cl.CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+
+	// Plenty of requests are left now, so there's no waiting.
+	start = time.Now()
+	_, err = cl.CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 80*time.Millisecond)
+}
+
+func TestTranslateRequestTemperature(t *testing.T) {
+	res, err := TranslateRequest(client.ChatCompletionRequest{Model: "gpt-4"})
+	assert.NoError(t, err)
+	body, err := json.Marshal(res)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(body), "temperature", "an unset temperature uses the default")
+
+	// go-openai omits a temperature of 0, so it has to be sent as something
+	// else for it to have an effect.
+	zero := float32(0)
+	res, err = TranslateRequest(client.ChatCompletionRequest{Model: "gpt-4", Temperature: &zero})
+	assert.NoError(t, err)
+	body, err = json.Marshal(res)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"temperature":`)
+	assert.InDelta(t, 0, res.Temperature, 1e-6)
+}
@@ -0,0 +1,201 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPoolExhausted is returned (wrapped by RateLimited) by a pool client when
+// all its members are ejected.
+var ErrPoolExhausted = errors.New("all pool members are rate limited")
+
+// PoolStrategy decides which member of a pool gets a request.
+type PoolStrategy int
+
+const (
+	// RoundRobin sends requests to the members in turn.
+	RoundRobin PoolStrategy = iota
+	// LeastOutstanding sends requests to the member with the fewest requests
+	// in flight.
+	LeastOutstanding
+)
+
+// PoolPolicy configures Pool.
+type PoolPolicy struct {
+	Strategy PoolStrategy
+	// EjectFor is how long a member that returned a rate limit error (see
+	// RateLimited) is taken out of rotation. Zero means that members are
+	// never ejected.
+	EjectFor time.Duration
+}
+
+type poolMember struct {
+	client       Client
+	outstanding  int
+	ejectedUntil time.Time
+}
+
+type poolClient struct {
+	policy PoolPolicy
+
+	mu      sync.Mutex
+	members []*poolMember
+	next    int
+}
+
+// Pool returns a client that distributes requests across members, which
+// should be clients of the same provider with different API keys or
+// deployments. If a member returns a rate limit error, it is ejected for
+// policy.EjectFor and the request is retried with another member. If all the
+// members are rate limited, the last rate limit error is returned, and
+// requests made while all the members are ejected fail with ErrPoolExhausted
+// (wrapped by RateLimited), so that Retrying can wait before trying again.
+func Pool(policy PoolPolicy, members ...Client) Client {
+	if len(members) == 0 {
+		panic("pool must have at least one member")
+	}
+	pool := &poolClient{policy: policy}
+	for _, member := range members {
+		pool.members = append(pool.members, &poolMember{client: member})
+	}
+	return pool
+}
+
+// acquire picks a member that is not ejected and not in tried, and marks a
+// request to it as outstanding. It returns nil if there is no such member.
+func (pool *poolClient) acquire(tried map[*poolMember]bool) *poolMember {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := time.Now()
+	var picked *poolMember
+	pickedIndex := 0
+	for i := range pool.members {
+		index := (pool.next + i) % len(pool.members)
+		member := pool.members[index]
+		if tried[member] || now.Before(member.ejectedUntil) {
+			continue
+		}
+		// Members are scanned starting after the last one picked, so that
+		// ties are broken in turn.
+		if picked == nil || member.outstanding < picked.outstanding {
+			picked, pickedIndex = member, index
+		}
+		if pool.policy.Strategy == RoundRobin {
+			break
+		}
+	}
+	if picked != nil {
+		picked.outstanding++
+		pool.next = pickedIndex + 1
+	}
+	return picked
+}
+
+func (pool *poolClient) release(member *poolMember, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	member.outstanding--
+	if pool.policy.EjectFor > 0 && IsRateLimited(err) {
+		log.WithError(err).WithField("for", pool.policy.EjectFor).Warn("Ejecting rate limited pool member")
+		member.ejectedUntil = time.Now().Add(pool.policy.EjectFor)
+	}
+}
+
+func (pool *poolClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	tried := make(map[*poolMember]bool)
+	lastErr := RateLimited(ErrPoolExhausted)
+	for {
+		member := pool.acquire(tried)
+		if member == nil {
+			return ChatCompletionResponse{}, lastErr
+		}
+		tried[member] = true
+
+		resp, err := member.client.CreateChatCompletion(ctx, req)
+		pool.release(member, err)
+		if err == nil || !IsRateLimited(err) {
+			return resp, err
+		}
+		lastErr = err
+	}
+}
+
+// CreateChatCompletionStream implements StreamingClient. Members are picked
+// and ejected as for CreateChatCompletion, but a request is only retried with
+// another member if opening the stream fails; the member counts as
+// outstanding until the stream ends or is closed. Members that are not a
+// StreamingClient are skipped.
+func (pool *poolClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	tried := make(map[*poolMember]bool)
+	var lastErr error
+	for {
+		member := pool.acquire(tried)
+		if member == nil {
+			if lastErr == nil {
+				if len(tried) > 0 {
+					return nil, ErrStreamingNotSupported
+				}
+				return nil, RateLimited(ErrPoolExhausted)
+			}
+			return nil, lastErr
+		}
+		tried[member] = true
+
+		streaming, ok := member.client.(StreamingClient)
+		if !ok {
+			pool.release(member, nil)
+			continue
+		}
+		stream, err := streaming.CreateChatCompletionStream(ctx, req)
+		if err == nil {
+			return &poolStream{ChatCompletionStream: stream, pool: pool, member: member}, nil
+		}
+		pool.release(member, err)
+		if !IsRateLimited(err) {
+			return nil, err
+		}
+		lastErr = err
+	}
+}
+
+// poolStream releases its member once, when the stream ends or is closed.
+type poolStream struct {
+	ChatCompletionStream
+	pool     *poolClient
+	member   *poolMember
+	released bool
+}
+
+func (s *poolStream) release(err error) {
+	if s.released {
+		return
+	}
+	s.released = true
+	s.pool.release(s.member, err)
+}
+
+func (s *poolStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err == io.EOF {
+		s.release(nil)
+	} else if err != nil {
+		s.release(err)
+	}
+	return event, err
+}
+
+func (s *poolStream) Close() error {
+	s.release(nil)
+	return s.ChatCompletionStream.Close()
+}
+
+// Unwrap implements Wrapper, returning the first member.
+func (pool *poolClient) Unwrap() Client {
+	return pool.members[0].client
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolRoundRobin(t *testing.T) {
+	cl := Pool(PoolPolicy{Strategy: RoundRobin}, answering("a"), answering("b"))
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+		assert.NoError(t, err)
+		got = append(got, resp.Choices[0].Content)
+	}
+	assert.Equal(t, []string{"a:m", "b:m", "a:m", "b:m"}, got)
+}
+
+func TestPoolLeastOutstanding(t *testing.T) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	blocking := funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		close(started)
+		<-unblock
+		return answering("blocking")(ctx, req)
+	})
+	cl := Pool(PoolPolicy{Strategy: LeastOutstanding}, blocking, answering("free"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	}()
+	<-started
+
+	// The first member has a request in flight, so the second one should
+	// get the next requests.
+	for i := 0; i < 2; i++ {
+		resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, "free:", resp.Choices[0].Content)
+	}
+	close(unblock)
+	<-done
+}
+
+func TestPoolLeastOutstandingRotatesTies(t *testing.T) {
+	cl := Pool(PoolPolicy{Strategy: LeastOutstanding}, answering("a"), answering("b"), answering("c"))
+
+	// Sequential requests leave no request in flight, so every member is
+	// tied and they should take turns.
+	var got []string
+	for i := 0; i < 4; i++ {
+		resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{Model: "m"})
+		assert.NoError(t, err)
+		got = append(got, resp.Choices[0].Content)
+	}
+	assert.Equal(t, []string{"a:m", "b:m", "c:m", "a:m"}, got)
+}
+
+func TestPoolEjectsRateLimitedMembers(t *testing.T) {
+	limitedCalls := 0
+	limited := funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		limitedCalls++
+		return ChatCompletionResponse{}, RateLimited(errors.New("429"))
+	})
+	cl := Pool(PoolPolicy{Strategy: RoundRobin, EjectFor: time.Hour}, limited, answering("ok"))
+
+	for i := 0; i < 3; i++ {
+		resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, "ok:", resp.Choices[0].Content)
+	}
+	assert.Equal(t, 1, limitedCalls, "the rate limited member should have been ejected")
+
+	// When all members are ejected, the pool is exhausted.
+	cl = Pool(PoolPolicy{EjectFor: time.Hour}, limited)
+	_, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.True(t, IsRateLimited(err))
+	_, err = cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrPoolExhausted)
+}
+
+func TestPoolStreams(t *testing.T) {
+	limitedCalls := 0
+	limited := streamingFunc(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+		limitedCalls++
+		return nil, RateLimited(errors.New("429"))
+	})
+	ok := streamingAnswering{funcClient: answering("unused"), content: "hello there"}
+	cl := Pool(PoolPolicy{Strategy: LeastOutstanding, EjectFor: time.Hour}, limited, answering("plain"), ok).(*poolClient)
+
+	for i := 0; i < 2; i++ {
+		stream, err := cl.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, cl.members[2].outstanding, "the member is busy until the stream ends")
+		resp, err := CollectStream(stream, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello there", resp.Choices[0].Content)
+		assert.Equal(t, 0, cl.members[2].outstanding)
+	}
+	assert.Equal(t, 1, limitedCalls, "the rate limited member should have been ejected")
+
+	// None of the members can stream.
+	plain := Pool(PoolPolicy{}, answering("a"), answering("b")).(StreamingClient)
+	_, err := plain.CreateChatCompletionStream(context.Background(), ChatCompletionRequest{})
+	assert.ErrorIs(t, err, ErrStreamingNotSupported)
+}
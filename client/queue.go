@@ -0,0 +1,203 @@
+package client
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QueuePolicy configures Queued.
+type QueuePolicy struct {
+	// MaxInFlight is the maximum number of requests sent to the wrapped
+	// client at the same time.
+	MaxInFlight int
+	// OnDequeue, if not nil, is called when a request leaves the queue to be
+	// sent, with its priority and how long it waited.
+	OnDequeue func(priority int, wait time.Duration)
+}
+
+// waiter is a request waiting in the queue.
+type waiter struct {
+	priority int
+	seq      uint64
+	enqueued time.Time
+	// ready is closed when the request can be sent.
+	ready   chan struct{}
+	granted bool
+	index   int
+}
+
+// waiters is a heap of waiters, ordered by priority and then by arrival.
+type waiters []*waiter
+
+func (w waiters) Len() int { return len(w) }
+
+func (w waiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority > w[j].priority
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w waiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *waiters) Push(x any) {
+	item := x.(*waiter)
+	item.index = len(*w)
+	*w = append(*w, item)
+}
+
+func (w *waiters) Pop() any {
+	old := *w
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*w = old[:len(old)-1]
+	item.index = -1
+	return item
+}
+
+type queuedClient struct {
+	client Client
+	policy QueuePolicy
+
+	mu       sync.Mutex
+	inFlight int
+	queue    waiters
+	seq      uint64
+}
+
+// Queued wraps a Client and limits the number of requests in flight to
+// policy.MaxInFlight. Further requests wait in a queue, ordered by their
+// priority (see ChatCompletionRequest.Priority and WithPriority), and among
+// requests with the same priority, by arrival. This allows, for example,
+// interactive requests to go ahead of batch ones sharing the same API key.
+// Requests leave the queue if their context is done.
+func Queued(client Client, policy QueuePolicy) Client {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	if policy.MaxInFlight <= 0 {
+		panic("MaxInFlight must be positive")
+	}
+	return &queuedClient{
+		client: client,
+		policy: policy,
+	}
+}
+
+// acquire waits until the request can be sent.
+func (client *queuedClient) acquire(ctx context.Context, priority int) error {
+	client.mu.Lock()
+	if client.inFlight < client.policy.MaxInFlight && len(client.queue) == 0 {
+		client.inFlight++
+		client.mu.Unlock()
+		client.dequeued(priority, 0)
+		return nil
+	}
+	w := &waiter{
+		priority: priority,
+		seq:      client.seq,
+		enqueued: time.Now(),
+		ready:    make(chan struct{}),
+	}
+	client.seq++
+	heap.Push(&client.queue, w)
+	log.WithField("priority", priority).WithField("queued", len(client.queue)).Debug("Request queued")
+	client.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		client.dequeued(priority, time.Since(w.enqueued))
+		return nil
+	case <-ctx.Done():
+		client.mu.Lock()
+		granted := w.granted
+		if !granted {
+			heap.Remove(&client.queue, w.index)
+		}
+		client.mu.Unlock()
+		if granted {
+			// The slot was handed to us at the same time, so pass it on.
+			client.release()
+		}
+		return ctx.Err()
+	}
+}
+
+func (client *queuedClient) dequeued(priority int, wait time.Duration) {
+	if client.policy.OnDequeue != nil {
+		client.policy.OnDequeue(priority, wait)
+	}
+}
+
+// release frees the slot of a request, handing it to the next request in the
+// queue, if any.
+func (client *queuedClient) release() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.queue) == 0 {
+		client.inFlight--
+		return
+	}
+	w := heap.Pop(&client.queue).(*waiter)
+	w.granted = true
+	close(w.ready)
+}
+
+func (client *queuedClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	if err := client.acquire(ctx, Priority(ctx, req)); err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	defer client.release()
+	return client.client.CreateChatCompletion(ctx, req)
+}
+
+// CreateChatCompletionStream implements StreamingClient. A stream counts as in
+// flight until it is finished or closed.
+func (client *queuedClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	if err := client.acquire(ctx, Priority(ctx, req)); err != nil {
+		return nil, err
+	}
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		client.release()
+		return nil, err
+	}
+	return &queuedStream{ChatCompletionStream: stream, release: client.release}, nil
+}
+
+// queuedStream releases its slot once, when it finishes or is closed.
+type queuedStream struct {
+	ChatCompletionStream
+	release func()
+	once    sync.Once
+}
+
+func (s *queuedStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err != nil {
+		s.once.Do(s.release)
+	}
+	return event, err
+}
+
+func (s *queuedStream) Close() error {
+	s.once.Do(s.release)
+	return s.ChatCompletionStream.Close()
+}
+
+// Unwrap implements Wrapper.
+func (client *queuedClient) Unwrap() Client {
+	return client.client
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// waitForQueue waits until cl has n requests queued.
+func waitForQueue(t *testing.T, cl *queuedClient, n int) {
+	t.Helper()
+	assert.Eventually(t, func() bool {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		return len(cl.queue) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestQueuedPriority(t *testing.T) {
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	backend := funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		if req.Model == "blocking" {
+			<-unblock
+		}
+		mu.Lock()
+		order = append(order, req.Model)
+		mu.Unlock()
+		return answering("ok")(ctx, req)
+	})
+	var waits []int
+	cl := Queued(backend, QueuePolicy{MaxInFlight: 1, OnDequeue: func(priority int, wait time.Duration) {
+		waits = append(waits, priority)
+	}}).(*queuedClient)
+
+	var wg sync.WaitGroup
+	send := func(ctx context.Context, req ChatCompletionRequest) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cl.CreateChatCompletion(ctx, req)
+			assert.NoError(t, err)
+		}()
+	}
+	send(context.Background(), ChatCompletionRequest{Model: "blocking"})
+	assert.Eventually(t, func() bool {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		return cl.inFlight == 1
+	}, time.Second, time.Millisecond)
+
+	send(context.Background(), ChatCompletionRequest{Model: "batch"})
+	waitForQueue(t, cl, 1)
+	send(context.Background(), ChatCompletionRequest{Model: "batch-2"})
+	waitForQueue(t, cl, 2)
+	send(WithPriority(context.Background(), 10), ChatCompletionRequest{Model: "interactive"})
+	waitForQueue(t, cl, 3)
+	send(context.Background(), ChatCompletionRequest{Model: "urgent", Priority: 20})
+	waitForQueue(t, cl, 4)
+
+	close(unblock)
+	wg.Wait()
+	assert.Equal(t, []string{"blocking", "urgent", "interactive", "batch", "batch-2"}, order)
+	assert.Equal(t, []int{0, 20, 10, 0, 0}, waits)
+}
+
+func TestQueuedCancel(t *testing.T) {
+	unblock := make(chan struct{})
+	backend := funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		<-unblock
+		return answering("ok")(ctx, req)
+	})
+	cl := Queued(backend, QueuePolicy{MaxInFlight: 1}).(*queuedClient)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	}()
+	assert.Eventually(t, func() bool {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		return cl.inFlight == 1
+	}, time.Second, time.Millisecond)
+
+	// A queued request gives up when its context is done, and leaves the
+	// queue.
+	_, err := cl.CreateChatCompletion(quickly(t), ChatCompletionRequest{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	waitForQueue(t, cl, 0)
+
+	close(unblock)
+	<-done
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	assert.Equal(t, 0, cl.inFlight)
+}
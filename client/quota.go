@@ -0,0 +1,283 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Quota is a limit on the use of a model, like the ones set by OpenAI and
+// Anthropic for each API key.
+type Quota struct {
+	// RequestsPerMinute is the maximum number of requests per minute. Zero
+	// means no limit.
+	RequestsPerMinute int
+	// TokensPerMinute is the maximum number of tokens (prompt and
+	// completion) per minute. Zero means no limit.
+	TokensPerMinute int
+}
+
+// QuotaPolicy configures QuotaLimiting.
+type QuotaPolicy struct {
+	// Quotas maps model names to their quotas.
+	Quotas map[string]Quota
+	// Default is the quota of models that are not in Quotas.
+	Default Quota
+	// CountTokens is used to estimate the number of tokens of a request
+	// before sending it, and of the response if the client doesn't report
+	// usage. It must be set if any quota has TokensPerMinute.
+	CountTokens func(string) (int, error)
+}
+
+func (policy QuotaPolicy) quota(model string) Quota {
+	if quota, ok := policy.Quotas[model]; ok {
+		return quota
+	}
+	return policy.Default
+}
+
+// bucket is a token bucket that holds up to capacity tokens, and is refilled
+// at perSecond tokens per second. Reservations can take more tokens than
+// available, and then have to wait for the bucket to refill.
+type bucket struct {
+	capacity  float64
+	perSecond float64
+	available float64
+	last      time.Time
+}
+
+// newBucket returns a full bucket for a limit per minute, or nil if there is
+// no limit.
+func newBucket(perMinute int) *bucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &bucket{
+		capacity:  float64(perMinute),
+		perSecond: float64(perMinute) / 60,
+		available: float64(perMinute),
+		last:      time.Now(),
+	}
+}
+
+func (b *bucket) advance(now time.Time) {
+	b.available = math.Min(b.capacity, b.available+now.Sub(b.last).Seconds()*b.perSecond)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long to wait before they are
+// available.
+func (b *bucket) reserve(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.advance(now)
+	b.available -= n
+	if b.available >= 0 {
+		return 0
+	}
+	return time.Duration(-b.available / b.perSecond * float64(time.Second))
+}
+
+// refund returns n tokens to the bucket. n can be negative to take more
+// tokens without waiting for them.
+func (b *bucket) refund(n float64, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.advance(now)
+	b.available = math.Min(b.capacity, b.available+n)
+}
+
+type modelQuota struct {
+	requests *bucket
+	tokens   *bucket
+}
+
+type quotaLimitingClient struct {
+	client Client
+	policy QuotaPolicy
+
+	mu     sync.Mutex
+	models map[string]*modelQuota
+}
+
+// QuotaLimiting wraps a Client and keeps the requests to each model within
+// their quota of requests and tokens per minute, making requests wait until
+// there's enough quota. Unlike RateLimiting, it takes into account the size
+// of the requests: before sending a request, it reserves the tokens of the
+// messages (counted with policy.CountTokens) plus MaxTokens, and once the
+// response arrives it corrects the reservation using the reported usage. If
+// the request fails, its tokens are returned to the quota.
+//
+// Requests that need more tokens than a whole minute of quota fail
+// immediately.
+func QuotaLimiting(client Client, policy QuotaPolicy) Client {
+	if client == nil {
+		panic("client must not be nil")
+	}
+	needsCounter := policy.Default.TokensPerMinute > 0
+	for _, quota := range policy.Quotas {
+		needsCounter = needsCounter || quota.TokensPerMinute > 0
+	}
+	if needsCounter && policy.CountTokens == nil {
+		panic("CountTokens must be set to limit tokens per minute")
+	}
+	return &quotaLimitingClient{
+		client: client,
+		policy: policy,
+		models: make(map[string]*modelQuota),
+	}
+}
+
+func (client *quotaLimitingClient) modelQuota(model string) *modelQuota {
+	if mq, ok := client.models[model]; ok {
+		return mq
+	}
+	quota := client.policy.quota(model)
+	mq := &modelQuota{
+		requests: newBucket(quota.RequestsPerMinute),
+		tokens:   newBucket(quota.TokensPerMinute),
+	}
+	client.models[model] = mq
+	return mq
+}
+
+// reserve waits until there's quota for req, and returns the number of
+// tokens it reserved.
+func (client *quotaLimitingClient) reserve(ctx context.Context, req ChatCompletionRequest) (int, error) {
+	client.mu.Lock()
+	mq := client.modelQuota(req.Model)
+	client.mu.Unlock()
+
+	tokens := 0
+	if mq.tokens != nil {
+		prompt, err := countPromptTokens(client.policy.CountTokens, req)
+		if err != nil {
+			return 0, err
+		}
+		tokens = prompt + req.MaxTokens
+		if float64(tokens) > mq.tokens.capacity {
+			return 0, fmt.Errorf("request for model %q needs an estimated %d tokens, more than its quota of %.0f per minute", req.Model, tokens, mq.tokens.capacity)
+		}
+	}
+
+	client.mu.Lock()
+	now := time.Now()
+	wait := mq.requests.reserve(1, now)
+	if tokensWait := mq.tokens.reserve(float64(tokens), now); tokensWait > wait {
+		wait = tokensWait
+	}
+	client.mu.Unlock()
+
+	if wait == 0 {
+		return tokens, nil
+	}
+	log.WithField("model", req.Model).WithField("wait", wait).Debug("Waiting for quota")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		client.mu.Lock()
+		now := time.Now()
+		mq.requests.refund(1, now)
+		mq.tokens.refund(float64(tokens), now)
+		client.mu.Unlock()
+		return 0, ctx.Err()
+	case <-timer.C:
+		return tokens, nil
+	}
+}
+
+// reconcile corrects the tokens reserved for req, now that the response is
+// known. If err is not nil, all the tokens are returned.
+func (client *quotaLimitingClient) reconcile(req ChatCompletionRequest, reserved int, resp ChatCompletionResponse, err error) {
+	client.mu.Lock()
+	mq := client.modelQuota(req.Model)
+	client.mu.Unlock()
+	if mq.tokens == nil {
+		return
+	}
+
+	used := 0
+	if err == nil {
+		used = resp.Usage.TotalTokens
+		if used == 0 {
+			usage, countErr := estimateUsage(client.policy.CountTokens, req, resp)
+			if countErr != nil {
+				log.WithError(countErr).Warn("Counting tokens of the response")
+				return
+			}
+			used = usage.TotalTokens
+		}
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	mq.tokens.refund(float64(reserved-used), time.Now())
+}
+
+func (client *quotaLimitingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+	reserved, err := client.reserve(ctx, req)
+	if err != nil {
+		return ChatCompletionResponse{}, err
+	}
+	resp, err := client.client.CreateChatCompletion(ctx, req)
+	client.reconcile(req, reserved, resp, err)
+	return resp, err
+}
+
+// CreateChatCompletionStream implements StreamingClient. The reservation is
+// corrected when the stream ends.
+func (client *quotaLimitingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	reserved, err := client.reserve(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := streaming.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		client.reconcile(req, reserved, ChatCompletionResponse{}, err)
+		return nil, err
+	}
+	return &quotaStream{ChatCompletionStream: stream, client: client, req: req, reserved: reserved}, nil
+}
+
+// quotaStream accumulates the events of a stream to reconcile its
+// reservation at the end.
+type quotaStream struct {
+	ChatCompletionStream
+	client   *quotaLimitingClient
+	req      ChatCompletionRequest
+	reserved int
+	acc      StreamAccumulator
+	done     bool
+}
+
+func (s *quotaStream) Recv() (StreamEvent, error) {
+	event, err := s.ChatCompletionStream.Recv()
+	if err == nil {
+		s.acc.Add(event)
+	} else if !s.done {
+		s.done = true
+		if err == io.EOF {
+			s.client.reconcile(s.req, s.reserved, s.acc.Response(), nil)
+		} else {
+			s.client.reconcile(s.req, s.reserved, ChatCompletionResponse{}, err)
+		}
+	}
+	return event, err
+}
+
+// Unwrap implements Wrapper.
+func (client *quotaLimitingClient) Unwrap() Client {
+	return client.client
+}
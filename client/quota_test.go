@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countWords(s string) (int, error) {
+	return len(strings.Fields(s)), nil
+}
+
+// usedClient answers every request reporting the given usage.
+func usedClient(totalTokens int) funcClient {
+	return func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		resp, err := answering("ok")(ctx, req)
+		resp.Usage = Usage{TotalTokens: totalTokens}
+		return resp, err
+	}
+}
+
+// quickly returns a context that is done before any real wait for quota is
+// over.
+func quickly(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestQuotaLimitingRequestsPerMinute(t *testing.T) {
+	cl := QuotaLimiting(usedClient(0), QuotaPolicy{
+		Quotas: map[string]Quota{"small": {RequestsPerMinute: 2}},
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := cl.CreateChatCompletion(quickly(t), ChatCompletionRequest{Model: "small"})
+		assert.NoError(t, err)
+	}
+	_, err := cl.CreateChatCompletion(quickly(t), ChatCompletionRequest{Model: "small"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Other models have their own quota, and the default one is unlimited.
+	for i := 0; i < 5; i++ {
+		_, err = cl.CreateChatCompletion(quickly(t), ChatCompletionRequest{Model: "other"})
+		assert.NoError(t, err)
+	}
+}
+
+func TestQuotaLimitingTokensPerMinute(t *testing.T) {
+	req := ChatCompletionRequest{
+		Model:     "model",
+		MaxTokens: 50,
+		Messages:  []Message{{Role: User, Content: "one two three four five"}},
+	}
+	policy := QuotaPolicy{
+		Default:     Quota{TokensPerMinute: 100},
+		CountTokens: countWords,
+	}
+
+	// Each request reserves 55 tokens, but only uses 10, so the quota is
+	// enough for many requests.
+	cl := QuotaLimiting(usedClient(10), policy)
+	for i := 0; i < 5; i++ {
+		_, err := cl.CreateChatCompletion(quickly(t), req)
+		assert.NoError(t, err)
+	}
+
+	// If they use all the tokens they reserved, the second one has to wait.
+	cl = QuotaLimiting(usedClient(55), policy)
+	_, err := cl.CreateChatCompletion(quickly(t), req)
+	assert.NoError(t, err)
+	_, err = cl.CreateChatCompletion(quickly(t), req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Without usage, the tokens of the response are counted: "ok:model" is
+	// a single token.
+	cl = QuotaLimiting(usedClient(0), policy)
+	for i := 0; i < 5; i++ {
+		_, err := cl.CreateChatCompletion(quickly(t), req)
+		assert.NoError(t, err)
+	}
+
+	// Requests that can never fit in the quota fail.
+	req.MaxTokens = 200
+	_, err = cl.CreateChatCompletion(quickly(t), req)
+	assert.ErrorContains(t, err, "more than its quota")
+}
@@ -4,70 +4,215 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/ryszard/agency/util/trace"
 	log "github.com/sirupsen/logrus"
 )
 
-func retry(client *retryingClient, fn func() (any, error)) (any, error) {
-	waitMultiplier := 1
+// Attempt describes an attempt made by Retrying, and is passed to the
+// callback set with OnAttempt.
+type Attempt struct {
+	// Number is the number of the attempt, starting at 1.
+	Number int
+	// Err is the error returned by the attempt, or nil if it succeeded.
+	Err error
+	// Wait is how long Retrying is going to wait before the next attempt. It
+	// is zero if there won't be a next attempt.
+	Wait time.Duration
+}
+
+// RetryOption configures Retrying and RetryingEmbeddings.
+type RetryOption func(*retryPolicy)
+
+// FullJitter makes Retrying wait a random duration between zero and the
+// exponential backoff, instead of the backoff itself. This spreads out the
+// retries of concurrent requests that failed at the same time.
+func FullJitter() RetryOption {
+	return func(p *retryPolicy) {
+		p.jitter = true
+	}
+}
+
+// AttemptTimeout sets a deadline for each attempt. An attempt that exceeds it
+// is retried, as long as the context of the request is not done. It doesn't
+// apply to CreateChatCompletionStream, as the deadline would also interrupt
+// reading the stream.
+func AttemptTimeout(timeout time.Duration) RetryOption {
+	return func(p *retryPolicy) {
+		p.attemptTimeout = timeout
+	}
+}
+
+// OnAttempt sets a function that is called after every attempt, for example
+// to log or count them.
+func OnAttempt(fn func(Attempt)) RetryOption {
+	return func(p *retryPolicy) {
+		p.onAttempt = fn
+	}
+}
+
+// retryPolicy configures retry.
+type retryPolicy struct {
+	baseWait       time.Duration
+	maxWait        time.Duration
+	maxRetries     int
+	jitter         bool
+	attemptTimeout time.Duration
+	onAttempt      func(Attempt)
+}
+
+func newRetryPolicy(baseWait time.Duration, maxWait time.Duration, maxRetries int, opts ...RetryOption) retryPolicy {
+	if maxRetries == 0 {
+		panic("maxRetries must not be 0")
+	}
+	policy := retryPolicy{
+		baseWait:   baseWait,
+		maxWait:    maxWait,
+		maxRetries: maxRetries,
+	}
+	for _, opt := range opts {
+		opt(&policy)
+	}
+	return policy
+}
+
+// backoff returns how long to wait after the given failed attempt (counting
+// from 1), before taking into account what the server asked for.
+func (policy retryPolicy) backoff(attempt int) time.Duration {
+	wait := policy.baseWait
+	for i := 1; i < attempt && wait < policy.maxWait; i++ {
+		wait *= 2
+	}
+	if wait > policy.maxWait {
+		wait = policy.maxWait
+	}
+	if policy.jitter && wait > 0 {
+		wait = time.Duration(rand.Int63n(int64(wait) + 1))
+	}
+	return wait
+}
+
+func retry(ctx context.Context, policy retryPolicy, fn func(ctx context.Context) (any, error)) (any, error) {
+	span := trace.FromContext(ctx)
 	var lastErr error
-	for i := 0; i < client.maxRetries; i++ {
-		resp, err := fn()
+	for attempt := 1; policy.maxRetries < 0 || attempt <= policy.maxRetries; attempt++ {
+		span.SetAttribute("attempts", attempt)
+		resp, err := policy.try(ctx, fn)
 		if err == nil {
+			policy.report(Attempt{Number: attempt})
 			return resp, nil
 		}
-		log.WithError(err).Error("Error from the API")
+		log.WithError(err).WithField("attempt", attempt).Error("Error from the API")
 		lastErr = err
 
 		// Check if error is retryable
 		var rerr *RetryableError
-		if !errors.As(err, &rerr) {
+		if !errors.As(err, &rerr) || ctx.Err() != nil {
 			// If error is not retryable, return it immediately
+			policy.report(Attempt{Number: attempt, Err: err})
 			return nil, err
 		}
+		if attempt == policy.maxRetries {
+			policy.report(Attempt{Number: attempt, Err: err})
+			break
+		}
 
-		wait := time.Duration(waitMultiplier) * client.baseWait
+		wait := policy.backoff(attempt)
+		if after := rerr.RetryAfter(); after > wait {
+			wait = after
+		}
+		policy.report(Attempt{Number: attempt, Err: err, Wait: wait})
 		log.WithField("wait", wait).Info("Waiting before retrying")
-		if wait > client.maxWait {
-			wait = client.maxWait
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("retrying aborted after error %v: %w", lastErr, ctx.Err())
+		case <-timer.C:
 		}
-		time.Sleep(wait)
-		waitMultiplier *= 2
 	}
 
 	return nil, fmt.Errorf("max retries exceeded for error: %w", lastErr)
 }
 
+// try makes one attempt, applying the attempt timeout. If the attempt times
+// out, the error is made retryable.
+func (policy retryPolicy) try(ctx context.Context, fn func(ctx context.Context) (any, error)) (any, error) {
+	if policy.attemptTimeout <= 0 {
+		return fn(ctx)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, policy.attemptTimeout)
+	defer cancel()
+	resp, err := fn(attemptCtx)
+	if err != nil && ctx.Err() == nil && attemptCtx.Err() == context.DeadlineExceeded {
+		var rerr *RetryableError
+		if !errors.As(err, &rerr) {
+			err = Retryable(err)
+		}
+	}
+	return resp, err
+}
+
+func (policy retryPolicy) report(attempt Attempt) {
+	if policy.onAttempt != nil {
+		policy.onAttempt(attempt)
+	}
+}
+
+// ParseRetryAfter returns how long the response headers ask the client to
+// wait before retrying, reading the Retry-After header (in seconds or as an
+// HTTP date), and the retry-after-ms header used by some APIs. It returns
+// zero if there is no such header.
+func ParseRetryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
 type retryingClient struct {
-	client     Client
-	baseWait   time.Duration
-	maxWait    time.Duration
-	maxRetries int
+	client Client
+	retryPolicy
 }
 
 // Retrying wraps a Client and retries requests if they fail, using exponential
 // backoff. After the first failure, it will wait baseWait, then twice that,
 // until it reaches either maxWait, or has made maxRetries attempts. Pass -1 to
 // maxRetries to retry forever. Retrying will panic if maxRetries is 0.
-func Retrying(client Client, baseWait time.Duration, maxWait time.Duration, maxRetries int) Client {
-	if maxRetries == 0 {
-		panic("maxRetries must not be 0")
-	}
+//
+// If the error says how long to wait (see RetryableError.RetryAfter), and it
+// is longer than the backoff, Retrying waits that long instead. Waiting is
+// interrupted when the context of the request is done.
+func Retrying(client Client, baseWait time.Duration, maxWait time.Duration, maxRetries int, opts ...RetryOption) Client {
 	if client == nil {
 		panic("client must not be nil")
 	}
 	return &retryingClient{
-		client:     client,
-		baseWait:   baseWait,
-		maxWait:    maxWait,
-		maxRetries: maxRetries,
+		client:      client,
+		retryPolicy: newRetryPolicy(baseWait, maxWait, maxRetries, opts...),
 	}
 }
 
 func (client *retryingClient) CreateChatCompletion(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
 	log.WithField("req", req).Debug("CreateChatCompletion")
-	resp, err := retry(client, func() (any, error) {
+	resp, err := retry(ctx, client.retryPolicy, func(ctx context.Context) (any, error) {
 		log.Trace("Calling client.client.CreateChatCompletion")
 		log.WithField("client", client.client).Trace("here")
 		return client.client.CreateChatCompletion(ctx, req)
@@ -78,3 +223,26 @@ func (client *retryingClient) CreateChatCompletion(ctx context.Context, req Chat
 	}
 	return resp.(ChatCompletionResponse), nil
 }
+
+// CreateChatCompletionStream implements StreamingClient. Only creating the
+// stream is retried; errors returned while reading it are passed to the caller.
+func (client *retryingClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error) {
+	streaming, ok := client.client.(StreamingClient)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+	policy := client.retryPolicy
+	policy.attemptTimeout = 0
+	stream, err := retry(ctx, policy, func(ctx context.Context) (any, error) {
+		return streaming.CreateChatCompletionStream(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream.(ChatCompletionStream), nil
+}
+
+// Unwrap implements Wrapper.
+func (client *retryingClient) Unwrap() Client {
+	return client.client
+}
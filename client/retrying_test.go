@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrying(t *testing.T) {
+	backend := &switchClient{err: Retryable(errors.New("overloaded"))}
+	var attempts []Attempt
+	cl := Retrying(backend, time.Millisecond, 4*time.Millisecond, 4, OnAttempt(func(a Attempt) {
+		attempts = append(attempts, a)
+	}))
+
+	_, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.ErrorContains(t, err, "max retries exceeded")
+	assert.Equal(t, 4, backend.calls)
+	var waits []time.Duration
+	for i, a := range attempts {
+		assert.Equal(t, i+1, a.Number)
+		assert.Error(t, a.Err)
+		waits = append(waits, a.Wait)
+	}
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 0}, waits)
+
+	// Errors that are not retryable are returned immediately.
+	backend = &switchClient{err: errors.New("invalid")}
+	cl = Retrying(backend, time.Millisecond, time.Millisecond, 4)
+	_, err = cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.EqualError(t, err, "invalid")
+	assert.Equal(t, 1, backend.calls)
+}
+
+func TestRetryingHonorsRetryAfter(t *testing.T) {
+	backend := &switchClient{err: RateLimitedAfter(errors.New("slow down"), 30*time.Millisecond)}
+	var waits []time.Duration
+	cl := Retrying(backend, time.Millisecond, time.Millisecond, 2, OnAttempt(func(a Attempt) {
+		waits = append(waits, a.Wait)
+	}))
+
+	start := time.Now()
+	_, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	assert.Equal(t, []time.Duration{30 * time.Millisecond, 0}, waits)
+}
+
+func TestRetryingStopsWhenContextIsDone(t *testing.T) {
+	backend := &switchClient{err: Retryable(errors.New("overloaded"))}
+	cl := Retrying(backend, time.Hour, time.Hour, -1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := cl.CreateChatCompletion(ctx, ChatCompletionRequest{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 1, backend.calls)
+}
+
+func TestRetryingAttemptTimeout(t *testing.T) {
+	calls := 0
+	cl := Retrying(funcClient(func(ctx context.Context, req ChatCompletionRequest) (ChatCompletionResponse, error) {
+		calls++
+		if calls == 1 {
+			<-ctx.Done()
+			return ChatCompletionResponse{}, ctx.Err()
+		}
+		return answering("ok")(ctx, req)
+	}), time.Millisecond, time.Millisecond, 3, AttemptTimeout(10*time.Millisecond))
+
+	resp, err := cl.CreateChatCompletion(context.Background(), ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok:", resp.Choices[0].Content)
+	assert.Equal(t, 2, calls)
+}
+
+func TestFullJitter(t *testing.T) {
+	policy := newRetryPolicy(time.Second, 10*time.Second, 5, FullJitter())
+	for attempt := 1; attempt < 10; attempt++ {
+		wait := policy.backoff(attempt)
+		assert.GreaterOrEqual(t, wait, time.Duration(0))
+		assert.LessOrEqual(t, wait, 10*time.Second)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		header http.Header
+		want   time.Duration
+	}{
+		{http.Header{}, 0},
+		{http.Header{"Retry-After": {"2"}}, 2 * time.Second},
+		{http.Header{"Retry-After-Ms": {"150"}, "Retry-After": {"1"}}, 150 * time.Millisecond},
+		{http.Header{"Retry-After": {"nonsense"}}, 0},
+	} {
+		assert.Equal(t, tc.want, ParseRetryAfter(tc.header), "header: %v", tc.header)
+	}
+
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	wait := ParseRetryAfter(http.Header{"Retry-After": {date}})
+	assert.Greater(t, wait, 50*time.Second)
+	assert.LessOrEqual(t, wait, time.Minute)
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrStreamingNotSupported is returned by CreateChatCompletionStream of client
+// wrappers when the wrapped client is not a StreamingClient.
+var ErrStreamingNotSupported = errors.New("streaming is not supported by the client")
+
+// StreamEvent is a single delta of a streamed chat completion.
+type StreamEvent struct {
+	// Content is the next fragment of the message content.
+	Content string `json:"content,omitempty"`
+	// ToolCalls are fragments of the tool calls the model is making.
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"`
+	// FinishReason is set on the event that finishes the message.
+	FinishReason FinishReason `json:"finish_reason,omitempty"`
+	// Usage is set if the provider reports token usage while streaming.
+	Usage *Usage `json:"usage,omitempty"`
+	// RateLimit is set, usually on the first event, if the provider reports
+	// the state of its rate limits.
+	RateLimit *RateLimit `json:"-"`
+}
+
+// ToolCallDelta is a fragment of a ToolCall. The first fragment of a call
+// usually carries its ID and Name, and the subsequent ones carry pieces of
+// Arguments. Index identifies the call the fragment belongs to.
+type ToolCallDelta struct {
+	Index     int    `json:"index"`
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+}
+
+// ChatCompletionStream is a stream of events returned by a StreamingClient.
+type ChatCompletionStream interface {
+	// Recv returns the next event. When the stream is finished, it returns
+	// io.EOF.
+	Recv() (StreamEvent, error)
+	// Close releases the resources of the stream. Closing a stream before
+	// reaching io.EOF cancels the request.
+	Close() error
+}
+
+// StreamingClient is a Client that can return chat completions as a stream of
+// events.
+type StreamingClient interface {
+	Client
+	CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest) (ChatCompletionStream, error)
+}
+
+// StreamAccumulator builds a ChatCompletionResponse from stream events. The
+// zero value is ready to use.
+type StreamAccumulator struct {
+	content      strings.Builder
+	toolCalls    []ToolCall
+	finishReason FinishReason
+	usage        Usage
+	rateLimit    *RateLimit
+}
+
+// Add adds an event to the accumulated response.
+func (acc *StreamAccumulator) Add(event StreamEvent) {
+	acc.content.WriteString(event.Content)
+	for _, delta := range event.ToolCalls {
+		for delta.Index >= len(acc.toolCalls) {
+			acc.toolCalls = append(acc.toolCalls, ToolCall{})
+		}
+		call := &acc.toolCalls[delta.Index]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Name != "" {
+			call.Name = delta.Name
+		}
+		call.Arguments += delta.Arguments
+	}
+	if event.FinishReason != "" {
+		acc.finishReason = event.FinishReason
+	}
+	if event.Usage != nil {
+		acc.usage = *event.Usage
+	}
+	if event.RateLimit != nil {
+		acc.rateLimit = event.RateLimit
+	}
+}
+
+// Response returns the response accumulated so far.
+func (acc *StreamAccumulator) Response() ChatCompletionResponse {
+	return ChatCompletionResponse{
+		Choices: []Choice{{
+			Message: Message{
+				Content:   acc.content.String(),
+				Role:      Assistant,
+				ToolCalls: acc.toolCalls,
+			},
+			FinishReason: acc.finishReason,
+		}},
+		Usage:     acc.usage,
+		RateLimit: acc.rateLimit,
+	}
+}
+
+// CollectStream reads stream until it is finished, writing the content to w
+// (if it is not nil), and returns the whole response. It closes the stream.
+func CollectStream(stream ChatCompletionStream, w io.Writer) (ChatCompletionResponse, error) {
+	defer stream.Close()
+	var acc StreamAccumulator
+	for {
+		event, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return ChatCompletionResponse{}, err
+		}
+		acc.Add(event)
+		if w != nil && event.Content != "" {
+			if _, err := io.WriteString(w, event.Content); err != nil {
+				return ChatCompletionResponse{}, err
+			}
+		}
+	}
+	return acc.Response(), nil
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sliceStream struct {
+	events []StreamEvent
+	closed bool
+}
+
+func (s *sliceStream) Recv() (StreamEvent, error) {
+	if len(s.events) == 0 {
+		return StreamEvent{}, io.EOF
+	}
+	event := s.events[0]
+	s.events = s.events[1:]
+	return event, nil
+}
+
+func (s *sliceStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestCollectStream(t *testing.T) {
+	stream := &sliceStream{events: []StreamEvent{
+		{Content: "Let me "},
+		{Content: "check."},
+		{ToolCalls: []ToolCallDelta{{Index: 0, ID: "call_1", Name: "bash"}}},
+		{ToolCalls: []ToolCallDelta{{Index: 0, Arguments: `{"script":`}}},
+		{ToolCalls: []ToolCallDelta{{Index: 0, Arguments: `"ls"}`}, {Index: 1, ID: "call_2", Name: "python", Arguments: `{}`}}},
+		{FinishReason: FinishReasonToolCalls, Usage: &Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}},
+	}}
+
+	var w strings.Builder
+	resp, err := CollectStream(stream, &w)
+	assert.NoError(t, err)
+	assert.True(t, stream.closed)
+	assert.Equal(t, "Let me check.", w.String())
+	assert.Equal(t, ChatCompletionResponse{
+		Choices: []Choice{{
+			Message: Message{
+				Content: "Let me check.",
+				Role:    Assistant,
+				ToolCalls: []ToolCall{
+					{ID: "call_1", Name: "bash", Arguments: `{"script":"ls"}`},
+					{ID: "call_2", Name: "python", Arguments: `{}`},
+				},
+			},
+			FinishReason: FinishReasonToolCalls,
+		}},
+		Usage: Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+	}, resp)
+}
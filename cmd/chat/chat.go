@@ -22,8 +22,24 @@ var (
 	temperature = flag.Float64("temperature", 0.7, "temperature")
 	logLevel    = flag.String("log_level", "error", "log level")
 	platform    = flag.String("platform", "openai", "platform to use")
+
+	fallbackPlatform = flag.String("fallback_platform", "", "platform to use if the primary one fails (optional)")
+	fallbackModel    = flag.String("fallback_model", "", "model to use with the fallback platform")
 )
 
+func newClient(platform string) (client.Client, error) {
+	switch platform {
+	case "openai":
+		return openai.New(os.Getenv("OPENAI_API_KEY")), nil
+	case "huggingface":
+		return huggingface.New(os.Getenv("HUGGINGFACE_API_KEY")), nil
+	case "anthropic":
+		return anthropic.New(os.Getenv("ANTHROPIC_API_KEY"))
+	default:
+		return nil, fmt.Errorf("unknown platform: %s", platform)
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -34,22 +50,24 @@ func main() {
 
 	log.SetLevel(level)
 	log.SetReportCaller(true)
-	var cl client.Client
-	switch *platform {
-	case "openai":
-		cl = openai.New(os.Getenv("OPENAI_API_KEY"))
-	case "huggingface":
-		cl = huggingface.New(os.Getenv("HUGGINGFACE_API_KEY"))
-	case "anthropic":
-		cl, err = anthropic.New(os.Getenv("ANTHROPIC_API_KEY"))
+	cl, err := newClient(*platform)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *fallbackPlatform != "" {
+		fallback, err := newClient(*fallbackPlatform)
 		if err != nil {
 			log.Fatal(err)
 		}
-	default:
-		log.Fatalf("unknown platform: %s", *platform)
+		secondary := client.Backend{Name: *fallbackPlatform, Client: fallback}
+		if *fallbackModel != "" {
+			secondary.Models = map[string]string{*model: *fallbackModel}
+		}
+		cl = client.Fallback(client.Backend{Name: *platform, Client: cl}, secondary)
 	}
 
-	cl = client.Retrying(cl, 1*time.Second, 30*time.Second, 20)
+	cl = client.Chain(cl, client.WithRetries(1*time.Second, 30*time.Second, 20))
 
 	bot := agent.New("assistant",
 		agent.WithClient(cl),
@@ -8,6 +8,7 @@ import (
 	"os"
 
 	"github.com/ryszard/agency/agent"
+	"github.com/ryszard/agency/client"
 	"github.com/ryszard/agency/client/openai"
 	log "github.com/sirupsen/logrus"
 )
@@ -29,6 +30,8 @@ var (
 	notes = flag.String("notes", "", "notes to use for the poem")
 
 	needsMoreWorkThreshold = flag.Float64("needs_more_work_threshold", 0.0, "threshold for the critic to say that the work needs more work")
+
+	budget = flag.Float64("budget", 0, "maximum amount of dollars to spend (0 means no limit)")
 )
 
 var criticSystem = `
@@ -121,7 +124,12 @@ func main() {
 	}
 
 	log.SetLevel(level)
-	client := openai.New(os.Getenv("OPENAI_API_KEY"))
+	cl := client.Budgeted(openai.New(os.Getenv("OPENAI_API_KEY")), client.Budget{
+		Limit:       *budget,
+		Prices:      openai.Prices,
+		CountTokens: agent.NaiveTokenCounter(1.55),
+	})
+	defer printSpending(cl)
 
 	log.WithFields(log.Fields{
 		"poet_temperature":   *poetTemperature,
@@ -137,14 +145,14 @@ func main() {
 
 	poet := agent.New(
 		"poet",
-		agent.WithClient(client),
+		agent.WithClient(cl),
 		agent.WithModel(*poetModel),
 		agent.WithTemperature(float32(*poetTemperature)),
 		agent.WithMaxTokens(*poetMaxTokens),
 		agent.WithStreaming(os.Stdout))
 	poet.System(poetSystem)
 	critic := agent.New("critic",
-		agent.WithClient(client),
+		agent.WithClient(cl),
 		agent.WithModel(*criticModel),
 		agent.WithTemperature(float32(*criticTemperature)),
 		agent.WithMaxTokens(*criticMaxTokens),
@@ -156,6 +164,7 @@ func main() {
 
 	poem, err := poet.Respond(context.Background())
 	if err != nil {
+		printSpending(cl)
 		log.Fatal(err)
 	}
 
@@ -175,6 +184,7 @@ func main() {
 		critic.Listen(fmt.Sprintf(criticUser, poetResponse.Text, poetResponse.Explanation, *notes))
 		feedback, err := critic.Respond(context.Background())
 		if err != nil {
+			printSpending(cl)
 			log.Fatal(err)
 		}
 
@@ -188,6 +198,7 @@ func main() {
 		poet.Listen(criticResponse.Feedback)
 		poem, err = poet.Respond(context.Background())
 		if err != nil {
+			printSpending(cl)
 			log.Fatal(err)
 		}
 
@@ -198,3 +209,11 @@ func main() {
 	}
 
 }
+
+func printSpending(cl *client.BudgetedClient) {
+	for name, spending := range cl.ByAgent() {
+		fmt.Printf("%s: %d requests, %d prompt tokens, %d completion tokens, $%.4f\n",
+			name, spending.Requests, spending.PromptTokens, spending.CompletionTokens, spending.Cost)
+	}
+	fmt.Printf("Total: $%.4f\n", cl.Total().Cost)
+}
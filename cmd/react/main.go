@@ -5,6 +5,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/ryszard/agency/agent"
@@ -15,6 +16,7 @@ import (
 	"github.com/ryszard/agency/tools/human"
 	"github.com/ryszard/agency/tools/python"
 	"github.com/ryszard/agency/util/cache"
+	"github.com/ryszard/agency/util/trace"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -26,6 +28,8 @@ var (
 	memoryTokens = flag.Int("memory_tokens", 1000, "number of tokens to keep in memory")
 	temperature  = flag.Float64("temperature", 0.7, "temperature")
 	logLevel     = flag.String("log_level", "info", "log level")
+	budget       = flag.Float64("budget", 0, "maximum amount of dollars to spend (0 means no limit)")
+	traceFile    = flag.String("trace", "", "if set, write trace spans to this file as JSON lines")
 
 	pythonPath = flag.String("python_path", "/opt/homebrew/anaconda3/bin/python", "path to a python interpreter")
 )
@@ -40,14 +44,29 @@ func main() {
 
 	log.SetLevel(level)
 
-	var cl client.Client = openai.New(os.Getenv("OPENAI_API_KEY"))
+	if *traceFile != "" {
+		exporter, err := trace.JSONFile(*traceFile)
+		if err != nil {
+			log.WithError(err).Fatal("error")
+		}
+		defer exporter.Close()
+		trace.SetTracer(trace.NewTracer(exporter))
+	}
+
+	budgeted := client.Budgeted(openai.New(os.Getenv("OPENAI_API_KEY")), client.Budget{
+		Limit:       *budget,
+		Prices:      openai.Prices,
+		CountTokens: agent.NaiveTokenCounter(1.55),
+	})
 
 	cach, err := cache.BoltDB("./cache.db")
 	if err != nil {
 		log.WithError(err).Fatal("error")
 	}
 
-	cl = client.Cached(cl, cach)
+	// Cache hits are free, so the budget is applied only to the requests that
+	// reach the API.
+	var cl client.Client = client.Cached(budgeted, cach)
 
 	ag := agent.New("pythonista",
 		agent.WithClient(cl),
@@ -73,6 +92,7 @@ func main() {
 	if *question != "" {
 
 		if err := reactor.Answer(context.Background(), *question); err != nil {
+			printSpending(budgeted)
 			log.WithError(err).Fatal("error")
 		}
 	}
@@ -82,13 +102,25 @@ func main() {
 		// Read the question from stdin.
 		fmt.Print("Question: ")
 		newQuestion, err := reader.ReadString('\n')
-		if err != nil {
+		if err == io.EOF {
+			break
+		} else if err != nil {
 			log.WithError(err).Fatal("error reading from stdin")
 		}
 
 		if err := reactor.Answer(context.Background(), newQuestion); err != nil {
+			printSpending(budgeted)
 			log.WithError(err).Fatal("error")
 		}
 
 	}
+	printSpending(budgeted)
+}
+
+func printSpending(cl *client.BudgetedClient) {
+	for model, spending := range cl.ByModel() {
+		fmt.Printf("%s: %d requests, %d prompt tokens, %d completion tokens, $%.4f\n",
+			model, spending.Requests, spending.PromptTokens, spending.CompletionTokens, spending.Cost)
+	}
+	fmt.Printf("Total: $%.4f\n", cl.Total().Cost)
 }
@@ -1,27 +1,54 @@
 package cache
 
 import (
+	"encoding/binary"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
+	log "github.com/sirupsen/logrus"
 )
 
-const bucketName = "cache"
+const (
+	bucketName = "cache"
+	// expiryBucketName is the bucket holding the expiration times of the
+	// entries that have one, as Unix nanoseconds.
+	expiryBucketName = "expiry"
+)
 
 // BoltDBCache is a BoltDB backed key-value store.
 type BoltDBCache struct {
 	db *bolt.DB
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// BoltOption configures BoltDB.
+type BoltOption func(*BoltDBCache)
+
+// SweepEvery makes the cache remove expired entries every interval, in the
+// background, until it is closed. Expired entries are always removed when
+// the cache is opened, and they are never returned.
+func SweepEvery(interval time.Duration) BoltOption {
+	return func(c *BoltDBCache) {
+		c.wg.Add(1)
+		go c.sweepEvery(interval)
+	}
 }
 
 // BoltDB returns a BoltDBCache, which is BoltDB backed key-value store.
-func BoltDB(filepath string) (*BoltDBCache, error) {
+func BoltDB(filepath string, opts ...BoltOption) (*BoltDBCache, error) {
 	db, err := bolt.Open(filepath, 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return nil, err
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists([]byte(expiryBucketName))
 		return err
 	})
 	if err != nil {
@@ -29,26 +56,60 @@ func BoltDB(filepath string) (*BoltDBCache, error) {
 		return nil, err
 	}
 
-	return &BoltDBCache{
-		db: db,
-	}, nil
+	c := &BoltDBCache{
+		db:   db,
+		stop: make(chan struct{}),
+	}
+	if _, err := c.Sweep(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
 }
 
 // Set adds a key-value pair to the cache.
 func (c *BoltDBCache) Set(key []byte, value []byte) error {
+	return c.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL adds a key-value pair that expires after ttl. If ttl is zero,
+// it never expires.
+func (c *BoltDBCache) SetWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	return c.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketName))
-		return b.Put(key, value)
+		if err := tx.Bucket([]byte(bucketName)).Put(key, value); err != nil {
+			return err
+		}
+		expiry := tx.Bucket([]byte(expiryBucketName))
+		if ttl <= 0 {
+			return expiry.Delete(key)
+		}
+		deadline := make([]byte, 8)
+		binary.BigEndian.PutUint64(deadline, uint64(time.Now().Add(ttl).UnixNano()))
+		return expiry.Put(key, deadline)
 	})
 }
 
+// expired returns true if the entry for key has expired.
+func expired(tx *bolt.Tx, key []byte, now time.Time) bool {
+	deadline := tx.Bucket([]byte(expiryBucketName)).Get(key)
+	return len(deadline) == 8 && now.UnixNano() >= int64(binary.BigEndian.Uint64(deadline))
+}
+
 // Get retrieves a key-value pair from the cache.
 func (c *BoltDBCache) Get(key []byte) (value []byte, ok bool, err error) {
 
 	err = c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(bucketName))
-		value = b.Get(key)
-		ok = value != nil
+		v := b.Get(key)
+		if v == nil || expired(tx, key, time.Now()) {
+			return nil
+		}
+		// The value is only valid during the transaction.
+		value = append([]byte(nil), v...)
+		ok = true
 
 		return nil
 	})
@@ -58,7 +119,92 @@ func (c *BoltDBCache) Get(key []byte) (value []byte, ok bool, err error) {
 	return value, ok, nil
 }
 
+// Delete removes the value for key, if there is one.
+func (c *BoltDBCache) Delete(key []byte) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte(bucketName)).Delete(key); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(expiryBucketName)).Delete(key)
+	})
+}
+
+// Range calls fn for every entry that hasn't expired, in key order, until fn
+// returns false. It reads all the entries first, so fn may modify the cache.
+func (c *BoltDBCache) Range(fn func(key, value []byte) bool) error {
+	var keys, values [][]byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		return tx.Bucket([]byte(bucketName)).ForEach(func(k, v []byte) error {
+			if !expired(tx, k, now) {
+				keys = append(keys, append([]byte(nil), k...))
+				values = append(values, append([]byte(nil), v...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if !fn(keys[i], values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Sweep removes the expired entries, returning how many there were.
+func (c *BoltDBCache) Sweep() (int, error) {
+	removed := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		var keys [][]byte
+		err := tx.Bucket([]byte(expiryBucketName)).ForEach(func(k, v []byte) error {
+			if expired(tx, k, now) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := tx.Bucket([]byte(bucketName)).Delete(key); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(expiryBucketName)).Delete(key); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+	return removed, err
+}
+
+func (c *BoltDBCache) sweepEvery(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			removed, err := c.Sweep()
+			if err != nil {
+				log.WithError(err).Error("BoltDBCache: sweeping expired entries failed")
+				continue
+			}
+			log.WithField("removed", removed).Debug("BoltDBCache: swept expired entries")
+		}
+	}
+}
+
 // Close releases all database resources.
 func (c *BoltDBCache) Close() error {
+	close(c.stop)
+	c.wg.Wait()
 	return c.db.Close()
 }
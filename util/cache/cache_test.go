@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltDBTTL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := BoltDB(path)
+	require.NoError(t, err)
+
+	require.NoError(t, c.SetWithTTL([]byte("short"), []byte("1"), 20*time.Millisecond))
+	require.NoError(t, c.Set([]byte("forever"), []byte("2")))
+	require.NoError(t, c.Set([]byte("deleted"), []byte("3")))
+	require.NoError(t, c.Delete([]byte("deleted")))
+
+	value, ok, err := c.Get([]byte("short"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(value))
+	assert.Equal(t, []string{"forever", "short"}, keys(t, c))
+
+	time.Sleep(30 * time.Millisecond)
+	_, ok, err = c.Get([]byte("short"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, []string{"forever"}, keys(t, c))
+
+	// Setting without a TTL clears the old one.
+	require.NoError(t, c.SetWithTTL([]byte("renewed"), []byte("4"), 20*time.Millisecond))
+	require.NoError(t, c.Set([]byte("renewed"), []byte("5")))
+	require.NoError(t, c.Close())
+
+	// Expired entries are removed when the cache is opened.
+	c, err = BoltDB(path, SweepEvery(time.Millisecond))
+	require.NoError(t, err)
+	defer c.Close()
+	time.Sleep(30 * time.Millisecond)
+	removed, err := c.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Equal(t, []string{"forever", "renewed"}, keys(t, c))
+}
+
+func TestBoltDBSweep(t *testing.T) {
+	c, err := BoltDB(filepath.Join(t.TempDir(), "cache.db"))
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.NoError(t, c.SetWithTTL([]byte("a"), []byte("1"), time.Millisecond))
+	require.NoError(t, c.SetWithTTL([]byte("b"), []byte("2"), time.Hour))
+	time.Sleep(5 * time.Millisecond)
+	removed, err := c.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+}
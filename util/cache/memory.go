@@ -1,32 +1,196 @@
 package cache
 
-import "sync"
+import (
+	"container/list"
+	"sync"
+	"time"
+)
 
-// MemoryCache is a simple, thread-safe in-memory key-value store.
+// MemoryCache is a thread-safe in-memory key-value store. It can be bounded
+// by the number of entries and by their size, in which case the least
+// recently used entries are evicted first.
 type MemoryCache struct {
 	sync.RWMutex
-	data map[string][]byte
+	maxEntries int
+	maxBytes   int
+
+	data map[string]*list.Element
+	// lru holds the entries, the most recently used first.
+	lru   *list.List
+	bytes int
+	// sweepAt is the number of entries at which Set sweeps the expired
+	// ones, which is twice the number left by the last sweep, so that
+	// sweeping takes amortized constant time.
+	sweepAt int
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryEntry) size() int {
+	return len(e.key) + len(e.value)
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
 }
 
 // Memory returns a MemoryCache, which is a simple, thread-safe in-memory
-// key-value store.
+// key-value store. It is not bounded, see LRU for one that is.
 func Memory() *MemoryCache {
+	return LRU(0, 0)
+}
+
+// LRU returns a MemoryCache that holds at most maxEntries entries, taking at
+// most maxBytes bytes (counting the keys and the values). A limit that is
+// zero is not enforced. When a limit is exceeded, the least recently used
+// entries are evicted.
+func LRU(maxEntries, maxBytes int) *MemoryCache {
 	return &MemoryCache{
-		data: make(map[string][]byte),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		data:       make(map[string]*list.Element),
+		lru:        list.New(),
 	}
 }
 
 func (c *MemoryCache) Get(key []byte) (value []byte, ok bool, err error) {
-	c.RLock()
-	defer c.RUnlock()
-	value, ok = c.data[string(key)]
-	return
-
+	c.Lock()
+	defer c.Unlock()
+	elem, ok := c.data[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := elem.Value.(*memoryEntry)
+	if entry.expired(time.Now()) {
+		c.remove(elem)
+		return nil, false, nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.value, true, nil
 }
 
 func (c *MemoryCache) Set(key []byte, value []byte) error {
+	return c.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL adds a key-value pair that expires after ttl. If ttl is zero,
+// it never expires.
+func (c *MemoryCache) SetWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	entry := &memoryEntry{key: string(key), value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if elem, ok := c.data[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.data[entry.key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+	c.evict()
+	if c.lru.Len() >= c.sweepAt {
+		c.sweep()
+		c.sweepAt = 2 * c.lru.Len()
+	}
+	return nil
+}
+
+// Delete removes the value for key, if there is one.
+func (c *MemoryCache) Delete(key []byte) error {
 	c.Lock()
 	defer c.Unlock()
-	c.data[string(key)] = value
+	if elem, ok := c.data[string(key)]; ok {
+		c.remove(elem)
+	}
+	return nil
+}
+
+// Range calls fn for every entry that hasn't expired, until fn returns
+// false, removing the expired ones. It works on a snapshot of the cache, so
+// fn may modify it.
+func (c *MemoryCache) Range(fn func(key, value []byte) bool) error {
+	c.Lock()
+	c.sweep()
+	entries := make([]*memoryEntry, 0, len(c.data))
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*memoryEntry))
+	}
+	c.Unlock()
+
+	for _, entry := range entries {
+		if !fn([]byte(entry.key), entry.value) {
+			break
+		}
+	}
 	return nil
 }
+
+// Sweep removes the expired entries, returning how many there were. Expired
+// entries are never returned, and they are removed when they are read, by
+// Range, and by Set every time the number of entries doubles.
+func (c *MemoryCache) Sweep() (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.sweep(), nil
+}
+
+// Len returns the number of entries in the cache, including the expired ones
+// that haven't been removed yet.
+func (c *MemoryCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.data)
+}
+
+// Bytes returns the size of the entries in the cache.
+func (c *MemoryCache) Bytes() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.bytes
+}
+
+// remove removes elem. The lock must be held.
+func (c *MemoryCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*memoryEntry)
+	delete(c.data, entry.key)
+	c.bytes -= entry.size()
+}
+
+// evict removes entries until the cache is within its limits, starting with
+// the expired ones. The lock must be held.
+func (c *MemoryCache) evict() {
+	if !c.overLimits() {
+		return
+	}
+	c.sweep()
+	// The most recently added entry is kept even if it is over maxBytes on
+	// its own.
+	for c.overLimits() && c.lru.Len() > 1 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// sweep removes the expired entries, returning how many there were. The lock
+// must be held.
+func (c *MemoryCache) sweep() int {
+	removed := 0
+	now := time.Now()
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if elem.Value.(*memoryEntry).expired(now) {
+			c.remove(elem)
+			removed++
+		}
+		elem = prev
+	}
+	return removed
+}
+
+func (c *MemoryCache) overLimits() bool {
+	return (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keys(t *testing.T, c interface {
+	Range(func(key, value []byte) bool) error
+}) []string {
+	var keys []string
+	assert.NoError(t, c.Range(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	return keys
+}
+
+func TestLRUEvictsByEntries(t *testing.T) {
+	c := LRU(2, 0)
+	c.Set([]byte("a"), []byte("1"))
+	c.Set([]byte("b"), []byte("2"))
+	// Using a makes b the least recently used.
+	_, ok, _ := c.Get([]byte("a"))
+	assert.True(t, ok)
+	c.Set([]byte("c"), []byte("3"))
+
+	_, ok, _ = c.Get([]byte("b"))
+	assert.False(t, ok)
+	assert.ElementsMatch(t, []string{"a", "c"}, keys(t, c))
+}
+
+func TestLRUEvictsByBytes(t *testing.T) {
+	c := LRU(0, 10)
+	c.Set([]byte("a"), []byte("1234"))
+	c.Set([]byte("b"), []byte("1234"))
+	assert.Equal(t, 10, c.Bytes())
+	c.Set([]byte("c"), []byte("12"))
+	assert.Equal(t, []string{"c", "b"}, keys(t, c))
+	assert.Equal(t, 8, c.Bytes())
+
+	// Replacing a value updates the size.
+	c.Set([]byte("c"), []byte("1"))
+	assert.Equal(t, 7, c.Bytes())
+}
+
+func TestMemoryTTLAndDelete(t *testing.T) {
+	c := Memory()
+	c.SetWithTTL([]byte("short"), []byte("1"), time.Millisecond)
+	c.Set([]byte("forever"), []byte("2"))
+	c.Set([]byte("deleted"), []byte("3"))
+	assert.NoError(t, c.Delete([]byte("deleted")))
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok, _ := c.Get([]byte("short"))
+	assert.False(t, ok)
+	value, ok, _ := c.Get([]byte("forever"))
+	assert.True(t, ok)
+	assert.Equal(t, "2", string(value))
+	assert.Equal(t, []string{"forever"}, keys(t, c))
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestMemoryDropsExpiredEntries(t *testing.T) {
+	c := Memory()
+	for i := 0; i < 100; i++ {
+		c.SetWithTTL([]byte{byte(i)}, []byte("1"), time.Millisecond)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// The entries were never read, but Set removes them as the cache grows.
+	for i := 100; i < 200; i++ {
+		c.SetWithTTL([]byte{byte(i)}, []byte("1"), time.Hour)
+	}
+	assert.Equal(t, 100, c.Len())
+
+	c.SetWithTTL([]byte("short"), []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	removed, err := c.Sweep()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, 100, c.Len())
+	assert.Equal(t, 200, c.Bytes())
+}
@@ -0,0 +1,135 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Record is a finished span, as passed to an Exporter.
+type Record struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	Name       string         `json:"name"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// Exporter receives the spans recorded by a Tracer returned by NewTracer,
+// when they end.
+type Exporter interface {
+	Export(record Record) error
+}
+
+type recordingTracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a Tracer that records spans in process, and passes them
+// to exporter when they end.
+func NewTracer(exporter Exporter) Tracer {
+	return &recordingTracer{exporter: exporter}
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &span{
+		exporter: t.exporter,
+		record: Record{
+			TraceID: newID(16),
+			SpanID:  newID(8),
+			Name:    name,
+			Start:   time.Now(),
+		},
+	}
+	if parent, ok := FromContext(ctx).(*span); ok {
+		s.record.TraceID = parent.record.TraceID
+		s.record.ParentID = parent.record.SpanID
+	}
+	return ctx, s
+}
+
+func newID(bytes int) string {
+	id := make([]byte, bytes)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+type span struct {
+	exporter Exporter
+
+	mu     sync.Mutex
+	record Record
+	ended  bool
+}
+
+func (s *span) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.record.Attributes == nil {
+		s.record.Attributes = make(map[string]any)
+	}
+	s.record.Attributes[key] = value
+}
+
+func (s *span) End(err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.record.End = time.Now()
+	if err != nil {
+		s.record.Error = err.Error()
+	}
+	record := s.record
+	s.mu.Unlock()
+
+	if err := s.exporter.Export(record); err != nil {
+		log.WithError(err).WithField("span", record.Name).Warn("Failed to export span")
+	}
+}
+
+// JSONFileExporter is an Exporter that writes spans to a file, as one JSON
+// object per line, so that traces can be inspected offline.
+type JSONFileExporter struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// JSONFile returns a JSONFileExporter writing to the file at path. If the
+// file exists, spans are appended to it.
+func JSONFile(path string) (*JSONFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileExporter{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Export implements Exporter.
+func (e *JSONFileExporter) Export(record Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.encoder.Encode(record)
+}
+
+// Close closes the file.
+func (e *JSONFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
@@ -0,0 +1,83 @@
+// Package trace provides tracing of agents, clients and tools. Spans are
+// linked parent to child through the context. By default nothing is recorded;
+// call SetTracer with a Tracer, for example one returned by NewTracer, to
+// start recording spans.
+package trace
+
+import (
+	"context"
+	"sync"
+)
+
+// Span is an operation being traced.
+type Span interface {
+	// SetAttribute records a value describing the operation, like the model
+	// used or the number of tokens.
+	SetAttribute(key string, value any)
+	// End finishes the span. If err is not nil, the span is marked as
+	// failed.
+	End(err error)
+}
+
+// Tracer starts spans. Implement it to send spans to a different tracing
+// backend.
+type Tracer interface {
+	// Start starts a span, which is a child of the span in ctx, if any. The
+	// returned context should carry what the Tracer needs to link children
+	// to the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+var (
+	mu     sync.RWMutex
+	tracer Tracer = noopTracer{}
+)
+
+// SetTracer sets the Tracer used by Start. Passing nil disables tracing.
+func SetTracer(t Tracer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if t == nil {
+		t = noopTracer{}
+	}
+	tracer = t
+}
+
+type spanKey struct{}
+
+// Start starts a span using the Tracer set with SetTracer. The returned
+// context carries the span, so that spans started with it are its children,
+// and code that doesn't own the span can add attributes to it with
+// FromContext. The span has to be ended by the caller.
+func Start(ctx context.Context, name string) (context.Context, Span) {
+	mu.RLock()
+	t := tracer
+	mu.RUnlock()
+	if _, ok := t.(noopTracer); ok {
+		// Don't bother wrapping the context if tracing is disabled.
+		return ctx, noopSpan{}
+	}
+	ctx, span := t.Start(ctx, name)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span stored in ctx by Start. If there is none, it
+// returns a span that does nothing, so it is always safe to use.
+func FromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+
+func (noopSpan) End(err error) {}
@@ -0,0 +1,81 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sliceExporter struct {
+	records []Record
+}
+
+func (e *sliceExporter) Export(record Record) error {
+	e.records = append(e.records, record)
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &sliceExporter{}
+	SetTracer(NewTracer(exporter))
+	t.Cleanup(func() { SetTracer(nil) })
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	FromContext(ctx).SetAttribute("model", "gpt-4")
+	child.End(errors.New("failed"))
+	parent.End(nil)
+	// Ending twice doesn't export twice.
+	parent.End(nil)
+
+	assert.Len(t, exporter.records, 2)
+	childRecord, parentRecord := exporter.records[0], exporter.records[1]
+	assert.Equal(t, "child", childRecord.Name)
+	assert.Equal(t, "failed", childRecord.Error)
+	assert.Equal(t, parentRecord.SpanID, childRecord.ParentID)
+	assert.Equal(t, parentRecord.TraceID, childRecord.TraceID)
+	assert.Empty(t, parentRecord.ParentID)
+	assert.Equal(t, map[string]any{"model": "gpt-4"}, parentRecord.Attributes)
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx := context.Background()
+	spanCtx, span := Start(ctx, "span")
+	assert.Equal(t, ctx, spanCtx)
+	span.SetAttribute("key", "value")
+	span.End(nil)
+	FromContext(ctx).SetAttribute("key", "value")
+}
+
+func TestJSONFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	exporter, err := JSONFile(path)
+	assert.NoError(t, err)
+	SetTracer(NewTracer(exporter))
+	t.Cleanup(func() { SetTracer(nil) })
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child")
+	child.SetAttribute("tokens", 10)
+	child.End(nil)
+	parent.End(nil)
+	assert.NoError(t, exporter.Close())
+
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record Record
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		names = append(names, record.Name)
+	}
+	assert.Equal(t, []string{"child", "parent"}, names)
+}